@@ -0,0 +1,151 @@
+// Word counting over whole texts. Large texts can be split into shards which
+// are counted in parallel.
+
+package counter
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// How often the counting loops check whether their context is done.
+const checkInterval = 4096
+
+// Counts the words which ProcessWords finds in 'text'. Returns ctx.Err() if
+// 'ctx' is done before counting finishes.
+func CountWords(ctx context.Context, text io.Reader) (map[string]int64, error) {
+	counts := make(map[string]int64)
+	var n int = 0
+	err := ProcessWords(text, func(word string) error {
+		if n%checkInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		n++
+		counts[word]++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// Like CountWords, but counts the first 'size' bytes of 'text' in up to
+// 'shards' chunks, in parallel. Chunks are split just after ASCII whitespace,
+// which never occurs inside a multi-byte UTF-8 sequence or a word, so the
+// counts are exactly those CountWords would produce. The first error from
+// any chunk is returned.
+func CountWordsSharded(ctx context.Context, text io.ReaderAt, size int64,
+	shards int) (map[string]int64, error) {
+	boundaries, err := shardBoundaries(text, size, shards)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]map[string]int64, len(boundaries)-1)
+	errs := make([]error, len(boundaries)-1)
+	var wait sync.WaitGroup
+	for i := range results {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			section := io.NewSectionReader(text, boundaries[i],
+				boundaries[i+1]-boundaries[i])
+			results[i], errs[i] = CountWords(ctx, section)
+			if errs[i] != nil {
+				// Stop the other shards.
+				cancel()
+			}
+		}(i)
+	}
+	wait.Wait()
+
+	// Report the first real failure, rather than the cancellations it caused.
+	for _, err := range errs {
+		if err != nil && err != context.Canceled {
+			return nil, err
+		}
+	}
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	counts := results[0]
+	for _, result := range results[1:] {
+		for word, count := range result {
+			counts[word] += count
+		}
+	}
+	return counts, nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// HELPERS
+
+// Returns the offsets which split the first 'size' bytes of 'text' into up
+// to 'shards' chunks, starting with 0 and ending with 'size'. Each chunk but
+// the last ends with an ASCII whitespace byte.
+func shardBoundaries(text io.ReaderAt, size int64,
+	shards int) ([]int64, error) {
+	if shards < 1 {
+		shards = 1
+	}
+	boundaries := []int64{0}
+	buffer := make([]byte, checkInterval)
+	for i := 1; i < shards; i++ {
+		offset := size * int64(i) / int64(shards)
+		last := boundaries[len(boundaries)-1]
+		if offset < last {
+			offset = last
+		}
+
+		// Scan forward to the next whitespace byte.
+		boundary := size
+	scan:
+		for offset < size {
+			n, err := text.ReadAt(buffer, offset)
+			if int64(n) > size-offset {
+				n = int(size - offset)
+			}
+			for j := 0; j < n; j++ {
+				if isASCIISpace(buffer[j]) {
+					boundary = offset + int64(j) + 1
+					break scan
+				}
+			}
+			offset += int64(n)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if boundary >= size {
+			break
+		}
+		if boundary > last {
+			boundaries = append(boundaries, boundary)
+		}
+	}
+	return append(boundaries, size), nil
+}
+
+// Reports whether 'b' is one of the ASCII bytes which bufio.ScanWords treats
+// as space.
+func isASCIISpace(b byte) bool {
+	switch b {
+	case ' ', '\t', '\n', '\v', '\f', '\r':
+		return true
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+package counter_test
+
+import (
+	"context"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+import . "github.com/sethpollen/dorkalonius/counter"
+
+// Pieces of text chosen to exercise word, dash and UTF-8 boundaries.
+var pieces = []string{
+	"the", "The", "cat", "don't", "foo--bar", "--", "-", "naïve", "Ünïcödé",
+	"日本語", "\xff\xfe", "89", "a", "ok!", ":joe", " ", " ", "  ", "\t", "\n",
+	"\r\n", " ", "　", " ",
+}
+
+func randomText(r *rand.Rand, n int) string {
+	var text []string
+	for i := 0; i < n; i++ {
+		text = append(text, pieces[r.Intn(len(pieces))])
+	}
+	return strings.Join(text, "")
+}
+
+func TestCountWordsSharded(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	ctx := context.Background()
+	for trial := 0; trial < 50; trial++ {
+		text := randomText(r, r.Intn(500))
+		expected, err := CountWords(ctx, strings.NewReader(text))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for shards := 0; shards < 20; shards++ {
+			actual, err := CountWordsSharded(ctx, strings.NewReader(text),
+				int64(len(text)), shards)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(expected, actual) {
+				t.Fatalf("Text %q with %d shards: expected %v, got %v",
+					text, shards, expected, actual)
+			}
+		}
+	}
+}
+
+func TestCountWordsShardedEdgeCases(t *testing.T) {
+	ctx := context.Background()
+	for _, text := range []string{"", " ", "word", "one two", "  a  "} {
+		expected, _ := CountWords(ctx, strings.NewReader(text))
+		actual, err := CountWordsSharded(ctx, strings.NewReader(text),
+			int64(len(text)), 8)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(expected, actual) {
+			t.Errorf("Text %q: expected %v, got %v", text, expected, actual)
+		}
+	}
+
+	// Only the first 'size' bytes are counted.
+	counts, err := CountWordsSharded(ctx, strings.NewReader("one two three"),
+		7, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(counts, map[string]int64{"one": 1, "two": 1}) {
+		t.Errorf("Wrong counts: %v", counts)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	text := strings.Repeat("word ", 10000)
+	_, err = CountWordsSharded(cancelled, strings.NewReader(text),
+		int64(len(text)), 4)
+	if err != context.Canceled {
+		t.Errorf("Expected context.Canceled; got %v", err)
+	}
+}
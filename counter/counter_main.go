@@ -4,20 +4,27 @@
 package main
 
 import (
+	"context"
 	"encoding/csv"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/sethpollen/dorkalonius/counter"
 	"github.com/sethpollen/dorkalonius/gutenberg"
   "github.com/sethpollen/dorkalonius/util"
 	"github.com/sethpollen/dorkalonius/wiktionary"
-	"io"
 	"log"
 	"os"
+	"runtime"
 )
 
 var gutenbergEbook = flag.Bool("gutenberg_ebook", false,
 	"If true, interpret input files as Project Gutenberg ebooks.")
+var parallelism = flag.Int("parallelism", runtime.NumCPU(),
+	"Maximum number of input files to read at once.")
+var shards = flag.Int("shards", 1,
+	"Number of chunks to split each input file into, to be counted in "+
+		"parallel. Ignored with --gutenberg_ebook.")
 
 // Accepts a list of input files as command-line arguments.
 func main() {
@@ -29,49 +36,73 @@ func main() {
 		log.Fatalln(err)
 	}
 
-	tasks := make([]func() util.WordSet, flag.NArg())
+	tasks := make([]util.WordSetTask, flag.NArg())
 	for i := range tasks {
 		filename := flag.Arg(i)
-		tasks[i] = func() util.WordSet {
-			return readFile(inflectionMap, filename)
+		tasks[i] = util.WordSetTask{
+			Name: filename,
+			Run: func(ctx context.Context) (util.WordSet, error) {
+				return readFile(ctx, inflectionMap, filename)
+			},
 		}
 	}
-	wordSet := util.BuildWordSet(tasks)
+	wordSet, err := util.BuildWordSetContext(context.Background(), tasks,
+		*parallelism, func(name string, done, total int) {
+			log.Printf("Read %s (%d/%d)\n", name, done, total)
+		})
+	if err != nil {
+		log.Fatalln(err)
+	}
 
 	csvWriter := csv.NewWriter(os.Stdout)
-	for _, word := range wordSet.GetWords() {
+	words := wordSet.ByWeight()
+	for word, ok := words.Next(); ok; word, ok = words.Next() {
 		csvWriter.Write([]string{word.Word, fmt.Sprintf("%d", word.Weight)})
 	}
 	csvWriter.Flush()
 }
 
 func readFile(
+	ctx context.Context,
 	inflectionMap *wiktionary.InflectionMap,
-	filename string) util.WordSet {
+	filename string) (util.WordSet, error) {
 
-	var input io.Reader
-	var err error
-	input, err = os.Open(filename)
+	file, err := os.Open(filename)
 	if err != nil {
-		log.Fatalln(err)
+		return util.NewWordSet(), err
 	}
+	defer file.Close()
 
+	var counts map[string]int64
 	if *gutenbergEbook {
-		input = gutenberg.NewEbookReader(input)
+		counts, err = counter.CountWords(ctx, gutenberg.NewEbookReader(file))
+	} else if *shards > 1 {
+		var info os.FileInfo
+		info, err = file.Stat()
+		if err != nil {
+			return util.NewWordSet(), err
+		}
+		counts, err = counter.CountWordsSharded(ctx, file, info.Size(), *shards)
+	} else {
+		counts, err = counter.CountWords(ctx, file)
+	}
+	if err != nil {
+		return util.NewWordSet(), err
 	}
 
-	wordSet := util.NewWordSet()
-	err = counter.ProcessWords(input, func(word string) error {
+	// Merge the inflections of each word.
+	baseCounts := make(map[string]int64)
+	for word, count := range counts {
 		word = inflectionMap.GetBaseWord(word)
 		if len(word) == 0 {
-			log.Fatalln("Empty word")
+			return util.NewWordSet(), errors.New("Empty word")
 		}
-		wordSet.Add(util.WeightedWord{word, 1})
-		return nil
-	})
-	if err != nil {
-		log.Fatalln(err)
+		baseCounts[word] += count
 	}
 
-	return wordSet
+	words := make([]util.WeightedWord, 0, len(baseCounts))
+	for word, count := range baseCounts {
+		words = append(words, util.WeightedWord{Word: word, Weight: count})
+	}
+	return util.NewWordSetFromSlice(words)
 }
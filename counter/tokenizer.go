@@ -0,0 +1,189 @@
+// Configurable rules for breaking text into words.
+
+package counter
+
+import (
+	"bufio"
+	"golang.org/x/text/unicode/norm"
+	"io"
+	"strings"
+	"unicode"
+)
+
+// Breaks text into words.
+type Tokenizer interface {
+	// Passes each word in 'text' to 'process', in order. Aborts if 'process'
+	// returns any error, or if reading 'text' fails.
+	Tokenize(text io.Reader, process func(word string) error) error
+}
+
+// How an EnglishTokenizer treats apostrophes inside words. Apostrophes at
+// the start or end of a word are always trimmed, like other punctuation.
+type ApostropheMode int
+
+const (
+	// Keep apostrophes, so "don't" and "o'clock" are single words.
+	ApostropheKeep ApostropheMode = iota
+	// Delete apostrophes, so "don't" becomes "dont".
+	ApostropheRemove
+	// Split off English clitics, so "don't" becomes "do" and "n't", and
+	// "cat's" becomes "cat" and "'s". Other words, like "o'clock", are kept
+	// whole.
+	ApostropheSplitClitics
+)
+
+type EnglishOptions struct {
+	Apostrophes ApostropheMode
+
+	// If true, hyphenated compounds like "well-known" are single words.
+	// Otherwise they are split at the hyphens. Double hyphens ("--") always
+	// split words, since they stand in for dashes.
+	KeepHyphenated bool
+
+	// If true, text is put in Unicode normalization form C, so precomposed
+	// and decomposed accented letters give the same word. Curly quotes and
+	// other Unicode apostrophes, hyphens and dashes are mapped to their ASCII
+	// counterparts before the other rules apply, and combining marks are kept
+	// as part of words.
+	NormalizeUnicode bool
+
+	// If true, words are lowercased.
+	FoldCase bool
+
+	// If true, digits are word characters, so "1984" and "mp3" are words.
+	// Otherwise digits at the start or end of a word are trimmed, like
+	// punctuation.
+	KeepDigits bool
+}
+
+// The rules used by ProcessWords.
+func LegacyEnglishOptions() EnglishOptions {
+	return EnglishOptions{
+		Apostrophes:      ApostropheKeep,
+		KeepHyphenated:   true,
+		NormalizeUnicode: false,
+		FoldCase:         true,
+		KeepDigits:       false,
+	}
+}
+
+// The recommended rules for English text.
+func DefaultEnglishOptions() EnglishOptions {
+	options := LegacyEnglishOptions()
+	options.NormalizeUnicode = true
+	return options
+}
+
+// Splits text at whitespace and dashes, then trims punctuation from each
+// word, as configured by its options.
+type EnglishTokenizer struct {
+	Options EnglishOptions
+}
+
+func NewEnglishTokenizer(options EnglishOptions) *EnglishTokenizer {
+	return &EnglishTokenizer{options}
+}
+
+// Returns bufio.ErrTooLong if 'text' holds a run of more than
+// bufio.MaxScanTokenSize bytes without whitespace.
+func (self *EnglishTokenizer) Tokenize(text io.Reader,
+	process func(word string) error) error {
+	scanner := bufio.NewScanner(text)
+	scanner.Split(bufio.ScanWords)
+	for scanner.Scan() {
+		token := scanner.Text()
+		if self.Options.NormalizeUnicode {
+			token = punctuationReplacer.Replace(norm.NFC.String(token))
+		}
+		for _, word := range self.split(token) {
+			word = strings.TrimFunc(word, func(r rune) bool {
+				return !self.isWordRune(r)
+			})
+			if len(word) == 0 {
+				continue
+			}
+			if self.Options.FoldCase {
+				word = strings.ToLower(word)
+			}
+			for _, part := range self.handleApostrophes(word) {
+				if err := process(part); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// HELPERS
+
+// Maps Unicode punctuation to ASCII. Dashes become "--", so that they split
+// words.
+var punctuationReplacer = strings.NewReplacer(
+	"‘", "'", "’", "'", "ʼ", "'", "′", "'", "＇", "'",
+	"“", "\"", "”", "\"", "„", "\"", "″", "\"",
+	"＂", "\"",
+	"‐", "-", "‑", "-", "−", "-",
+	"–", "--", "—", "--", "―", "--",
+)
+
+// Splits 'token' at dashes and, unless hyphenated compounds are kept, at
+// hyphens.
+func (self *EnglishTokenizer) split(token string) []string {
+	if !self.Options.KeepHyphenated {
+		return strings.Split(token, "-")
+	}
+	return strings.Split(token, "--")
+}
+
+func (self *EnglishTokenizer) isWordRune(r rune) bool {
+	return unicode.IsLetter(r) ||
+		(self.Options.KeepDigits && unicode.IsDigit(r)) ||
+		(self.Options.NormalizeUnicode && unicode.In(r, unicode.Mn, unicode.Mc))
+}
+
+func isApostrophe(r rune) bool {
+	return r == '\'' || r == '’'
+}
+
+// English clitics which ApostropheSplitClitics splits off after an
+// apostrophe. "n't" is handled separately, since its apostrophe comes after
+// the "n".
+var clitics = map[string]bool{
+	"s": true, "re": true, "ve": true, "ll": true, "d": true, "m": true,
+}
+
+func (self *EnglishTokenizer) handleApostrophes(word string) []string {
+	switch self.Options.Apostrophes {
+	case ApostropheRemove:
+		word = strings.Map(func(r rune) rune {
+			if isApostrophe(r) {
+				return -1
+			}
+			return r
+		}, word)
+		if len(word) == 0 {
+			return nil
+		}
+	case ApostropheSplitClitics:
+		i := strings.LastIndexFunc(word, isApostrophe)
+		if i <= 0 {
+			break
+		}
+		prefix := word[:i]
+		// The apostrophe itself, followed by the suffix.
+		clitic := word[i:]
+		suffix := strings.TrimLeftFunc(clitic, isApostrophe)
+		lowerSuffix := strings.ToLower(suffix)
+		if clitics[lowerSuffix] {
+			return []string{prefix, clitic}
+		}
+		if lowerSuffix == "t" && len(prefix) > 1 &&
+			strings.HasSuffix(strings.ToLower(prefix), "n") {
+			n := len(prefix) - 1
+			return []string{prefix[:n], prefix[n:] + clitic}
+		}
+	}
+	return []string{word}
+}
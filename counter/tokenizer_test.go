@@ -0,0 +1,89 @@
+package counter_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+import . "github.com/sethpollen/dorkalonius/counter"
+
+func tokenize(t *testing.T, tokenizer Tokenizer, text string) []string {
+	var words []string
+	err := tokenizer.Tokenize(strings.NewReader(text), func(word string) error {
+		words = append(words, word)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return words
+}
+
+func checkTokens(t *testing.T, options EnglishOptions, text string,
+	expected ...string) {
+	actual := tokenize(t, NewEnglishTokenizer(options), text)
+	if len(actual) == 0 && len(expected) == 0 {
+		return
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("%+v on %q: expected %q, got %q", options, text, expected,
+			actual)
+	}
+}
+
+const sample = "Don’t say “well-known” at 5 o'clock—it's the MP3's 1984th time"
+
+func TestLegacyTokenizer(t *testing.T) {
+	legacy := LegacyEnglishOptions()
+	checkTokens(t, legacy, "Hey, :joe! 89 foo--bar",
+		"hey", "joe", "foo", "bar")
+	checkTokens(t, legacy, sample,
+		"don’t", "say", "well-known", "at", "o'clock—it's", "the", "mp3's",
+		"th", "time")
+
+	// ProcessWords uses the legacy rules.
+	var words []string
+	ProcessWords(strings.NewReader(sample), func(word string) error {
+		words = append(words, word)
+		return nil
+	})
+	expected := tokenize(t, NewEnglishTokenizer(legacy), sample)
+	if !reflect.DeepEqual(words, expected) {
+		t.Errorf("Expected %q, got %q", expected, words)
+	}
+}
+
+func TestEnglishTokenizerOptions(t *testing.T) {
+	options := DefaultEnglishOptions()
+	checkTokens(t, options, sample,
+		"don't", "say", "well-known", "at", "o'clock", "it's", "the", "mp3's",
+		"th", "time")
+	// Precomposed and decomposed accents give the same word.
+	checkTokens(t, options, "‘quoted’ caf\u00e9 cafe\u0301", "quoted",
+		"caf\u00e9", "caf\u00e9")
+	checkTokens(t, LegacyEnglishOptions(), "cafe\u0301", "cafe")
+	// Trailing spacing marks are kept too.
+	checkTokens(t, options, "\u0939\u093f\u0902\u0926\u0940.",
+		"\u0939\u093f\u0902\u0926\u0940")
+
+	options.KeepHyphenated = false
+	checkTokens(t, options, "well-known -- x-ray", "well", "known", "x", "ray")
+
+	options = DefaultEnglishOptions()
+	options.KeepDigits = true
+	checkTokens(t, options, "1984 mp3, 3d!", "1984", "mp3", "3d")
+
+	options = DefaultEnglishOptions()
+	options.FoldCase = false
+	checkTokens(t, options, "The CAT", "The", "CAT")
+
+	options = DefaultEnglishOptions()
+	options.Apostrophes = ApostropheRemove
+	checkTokens(t, options, "Don’t 'tis o'clock", "dont", "tis", "oclock")
+
+	options.Apostrophes = ApostropheSplitClitics
+	checkTokens(t, options,
+		"Don’t can't cat's we're I'd you'll they've I'm o'clock rock'n'roll",
+		"do", "n't", "ca", "n't", "cat", "'s", "we", "'re", "i", "'d", "you",
+		"'ll", "they", "'ve", "i", "'m", "o'clock", "rock'n'roll")
+}
@@ -1,32 +1,17 @@
 package counter
 
 import (
-	"bufio"
 	"io"
-	"strings"
-	"unicode"
 )
 
+var legacyTokenizer = NewEnglishTokenizer(LegacyEnglishOptions())
+
 // Breaks 'text' into individual words, as passes each one to 'process'. Aborts
-// if 'process' returns any error.
+// if 'process' returns any error. Words are split on whitespace and "--",
+// trimmed of non-letters and lowercased; see LegacyEnglishOptions.
+//
+// Errors from reading 'text' are returned, including bufio.ErrTooLong for an
+// overlong run of non-whitespace.
 func ProcessWords(text io.Reader, process func(string) error) error {
-	scanner := bufio.NewScanner(text)
-	scanner.Split(bufio.ScanWords)
-	for scanner.Scan() {
-		// Also split words on em dashes.
-		for _, word := range strings.Split(scanner.Text(), "--") {
-			word = strings.TrimFunc(word, func(r rune) bool {
-				return !unicode.IsLetter(r)
-			})
-			if len(word) == 0 {
-				continue
-			}
-			word = strings.ToLower(word)
-			err := process(word)
-			if err != nil {
-				return err
-			}
-		}
-	}
-	return nil
+	return legacyTokenizer.Tokenize(text, process)
 }
@@ -1,8 +1,12 @@
 package counter_test
 
 import (
+	"bufio"
+	"errors"
+	"io"
 	"strings"
 	"testing"
+	"testing/iotest"
 )
 import . "github.com/sethpollen/dorkalonius/counter"
 
@@ -52,3 +56,22 @@ func TestWords(t *testing.T) {
 		t.Errorf("counter: %d", counter)
 	}
 }
+
+func TestReadErrors(t *testing.T) {
+	long := strings.Repeat("a", bufio.MaxScanTokenSize+1)
+	err := ProcessWords(strings.NewReader("ok "+long), func(string) error {
+		return nil
+	})
+	if err != bufio.ErrTooLong {
+		t.Errorf("Expected bufio.ErrTooLong, got %v", err)
+	}
+
+	failure := errors.New("read failed")
+	text := io.MultiReader(strings.NewReader("ok "), iotest.ErrReader(failure))
+	err = ProcessWords(text, func(string) error {
+		return nil
+	})
+	if err != failure {
+		t.Errorf("Expected the read error, got %v", err)
+	}
+}
@@ -2,7 +2,12 @@
 
 package dorkalonius
 
-import "github.com/sethpollen/dorkalonius/util"
+import (
+	"context"
+	"fmt"
+	"github.com/sethpollen/dorkalonius/util"
+	"math/rand"
+)
 
 type Game struct {
 	TargetWord     string
@@ -12,29 +17,146 @@ type Game struct {
 const (
 	numAvailableWords = 35
 
-	// Manual tuning parameters. We use a high bias for the target word
-	// in order to get something interesting. We use a much smaller bias
+	// Manual tuning parameters, as fractions of the set size. These become
+	// the node biases used for sampling. We use a high bias for the target
+	// word in order to get something interesting. We use a much smaller bias
 	// for the available words, since we want them to mostly reflect a
 	// typical selection of words.
 	targetWordBias    float64 = 3e-2
 	availableWordBias float64 = 3e-6
+
+	// COCA part of speech code for adjectives.
+	adjectivePos = "j"
 )
 
-func NewTargetWord() string {
-	adjectives := Get_coca_adjective_set()
-	adjective := adjectives.Sample(
-		1, int64(targetWordBias*float64(adjectives.Size())))
-	return adjective.GetWords()[0].Word
+// The adjectives from the COCA word set, filtered out once on first use.
+var adjectiveSetMemo = util.NewMemo(
+	func(ctx context.Context) (*util.WordSet, error) {
+		wordSet, err := Get_coca_word_set(ctx)
+		if err != nil {
+			return nil, err
+		}
+		adjectives := wordSet.Filter(func(word util.WeightedWord) bool {
+			return word.Attributes.PartOfSpeech == adjectivePos
+		})
+		return &adjectives, nil
+	})
+
+// The aggregated forms of the composite sets passed to NewGame, keyed by the
+// original set.
+var aggregatedSets = util.NewMemoMap(
+	func(ctx context.Context, wordSet *util.WordSet) (*util.WordSet, error) {
+		aggregated := wordSet.Aggregate()
+		return &aggregated, nil
+	},
+	util.MemoMapLimits[*util.WordSet]{MaxEntries: 4})
+
+// Chooses a target word, drawing all randomness from 'r'. 'ctx' bounds the
+// loading of the embedded word set on first use.
+func NewTargetWord(ctx context.Context, r *rand.Rand) (string, error) {
+	adjectives, err := adjectiveSetMemo.Get(ctx)
+	if err != nil {
+		return "", err
+	}
+	adjective, err := adjectives.SampleDistinct(r, 1,
+		targetNodeBias(adjectives))
+	if err != nil {
+		return "", err
+	}
+	return adjective.GetWords()[0].Word, nil
+}
+
+// Creates a new Game, drawing all randomness from 'r'. Two calls with
+// identically seeded sources produce identical games. If 'wordSet' uses
+// composite keys, its aggregated form is used, so that no word is offered
+// twice. That form is built on the first call and reused after, so
+// 'wordSet' must not change between calls.
+func NewGame(ctx context.Context, wordSet *util.WordSet,
+	r *rand.Rand) (*Game, error) {
+	if wordSet.IsComposite() {
+		var err error
+		if wordSet, err = aggregatedSets.Get(ctx, wordSet); err != nil {
+			return nil, err
+		}
+	}
+
+	// Pick the target word first, so that it doesn't depend on how many draws
+	// were needed to fill the available words.
+	targetWord, err := NewTargetWord(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	words, err := wordSet.SampleDistinct(r, numAvailableWords,
+		availableNodeBias(wordSet))
+	if err != nil {
+		return nil, err
+	}
+	return newGame(targetWord, words), nil
+}
+
+// Generates many games from the same word set. The alias tables used for
+// sampling are built once, up front, so each game is cheap to generate.
+// Games are reproducible from the seed of 'r', but they differ from those
+// NewGame produces for the same seed.
+type GameGenerator struct {
+	targetWords    *util.FrozenWordSet
+	availableWords *util.FrozenWordSet
 }
 
-func NewGame(wordSet *util.WordSet) *Game {
-	words := wordSet.Sample(numAvailableWords,
-		int64(availableWordBias*float64(wordSet.Size())))
+func NewGameGenerator(ctx context.Context,
+	wordSet *util.WordSet) (*GameGenerator, error) {
+	if wordSet.IsComposite() {
+		aggregated := wordSet.Aggregate()
+		wordSet = &aggregated
+	}
+
+	adjectives, err := adjectiveSetMemo.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	targetWords, err := adjectives.Freeze(targetNodeBias(adjectives))
+	if err != nil {
+		return nil, err
+	}
+	availableWords, err := wordSet.Freeze(availableNodeBias(wordSet))
+	if err != nil {
+		return nil, err
+	}
+	return &GameGenerator{targetWords, availableWords}, nil
+}
+
+// Creates a new Game, drawing all randomness from 'r'.
+func (self *GameGenerator) NewGame(r *rand.Rand) (*Game, error) {
+	targetWord, ok := self.targetWords.Draw(r)
+	if !ok {
+		return nil, fmt.Errorf("No target words to draw from")
+	}
+	words, err := self.availableWords.Sample(r, numAvailableWords)
+	if err != nil {
+		return nil, err
+	}
+	return newGame(targetWord.Word, words), nil
+}
+
+func newGame(targetWord string, words util.WordSet) *Game {
 	wordsSlice := words.GetWords()
 	bareWords := make([]string, len(wordsSlice))
 	for i := range wordsSlice {
 		bareWords[i] = wordsSlice[i].Word
 	}
+	return &Game{targetWord, bareWords}
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// HELPERS
+
+// Gets the node bias for choosing a target word from 'adjectives'.
+func targetNodeBias(adjectives *util.WordSet) int64 {
+	return int64(targetWordBias * float64(adjectives.Size()))
+}
 
-	return &Game{NewTargetWord(), bareWords}
+// Gets the node bias for choosing the available words from 'wordSet'.
+func availableNodeBias(wordSet *util.WordSet) int64 {
+	return int64(availableWordBias * float64(wordSet.Size()))
 }
@@ -4,15 +4,21 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/sethpollen/dorkalonius"
+	"log"
 	"math/rand"
 	"time"
 )
 
 func main() {
-	rand.Seed(time.Now().UTC().UnixNano())
+	r := rand.New(rand.NewSource(time.Now().UTC().UnixNano()))
 	for i := 0; i < 40; i++ {
-		fmt.Println(dorkalonius.NewTargetWord())
+		word, err := dorkalonius.NewTargetWord(context.Background(), r)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		fmt.Println(word)
 	}
 }
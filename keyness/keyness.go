@@ -0,0 +1,213 @@
+// Keyness statistics, which measure how typical each word is of a study
+// corpus when compared with a reference corpus. Each corpus is given as a
+// WordSet of word counts.
+//
+// The statistics follow the usual definitions in corpus linguistics:
+// log-likelihood (G²) and chi-square from the 2x2 contingency table of each
+// word, %DIFF (Gabrielatos and Marchi) and log-ratio (Hardie).
+
+package keyness
+
+import (
+	"encoding/csv"
+	"fmt"
+	"github.com/sethpollen/dorkalonius/util"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+)
+
+type Score struct {
+	Word string
+
+	// Occurrences of the word in each corpus.
+	StudyCount     int64
+	ReferenceCount int64
+
+	// G² and chi-square are negative if the word is relatively more frequent
+	// in the reference corpus, so that sorting in descending order puts the
+	// most typical words of the study corpus first.
+	LogLikelihood float64
+	ChiSquare     float64
+
+	// Difference in relative frequency, as a percentage of the reference
+	// frequency. This is +Inf for words absent from the reference corpus.
+	PercentDiff float64
+
+	// Binary log of the ratio of relative frequencies. A count of zero is
+	// replaced by 0.5, so that this is always finite.
+	LogRatio float64
+}
+
+// Statistics by which scores may be sorted.
+type Metric int
+
+const (
+	LogLikelihood Metric = iota
+	ChiSquare
+	PercentDiff
+	LogRatio
+)
+
+// Parses a metric name, as used in CSV headers: "log_likelihood",
+// "chi_square", "percent_diff" or "log_ratio".
+func ParseMetric(name string) (Metric, error) {
+	for i, metricName := range metricNames {
+		if name == metricName {
+			return Metric(i), nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown metric: %q", name)
+}
+
+func (self Metric) String() string {
+	return metricNames[self]
+}
+
+var metricNames = []string{
+	"log_likelihood",
+	"chi_square",
+	"percent_diff",
+	"log_ratio",
+}
+
+// Scores every word which occurs in either corpus, in alphabetical order.
+// Composite sets are aggregated first. Returns an error if either corpus is
+// empty.
+func Compare(study, reference util.WordSet) ([]Score, error) {
+	study = study.Aggregate()
+	reference = reference.Aggregate()
+	studyTotal := float64(study.Weight())
+	referenceTotal := float64(reference.Weight())
+	if studyTotal == 0 || referenceTotal == 0 {
+		return nil, fmt.Errorf("Cannot compare with an empty corpus")
+	}
+
+	scores := make([]Score, 0, study.Size())
+	studyWords := study.Iterator()
+	referenceWords := reference.Iterator()
+	s, sOk := studyWords.Next()
+	r, rOk := referenceWords.Next()
+	for sOk || rOk {
+		var score Score
+		if sOk && (!rOk || s.Word <= r.Word) {
+			score.Word = s.Word
+			score.StudyCount = s.Weight
+		}
+		if rOk && (!sOk || r.Word <= s.Word) {
+			score.Word = r.Word
+			score.ReferenceCount = r.Weight
+		}
+		if score.StudyCount > 0 {
+			s, sOk = studyWords.Next()
+		}
+		if score.ReferenceCount > 0 {
+			r, rOk = referenceWords.Next()
+		}
+
+		score.compute(studyTotal, referenceTotal)
+		scores = append(scores, score)
+	}
+	return scores, nil
+}
+
+// Gets the value of 'metric' for this score.
+func (self Score) Get(metric Metric) float64 {
+	switch metric {
+	case LogLikelihood:
+		return self.LogLikelihood
+	case ChiSquare:
+		return self.ChiSquare
+	case PercentDiff:
+		return self.PercentDiff
+	default:
+		return self.LogRatio
+	}
+}
+
+// Sorts 'scores' by descending 'metric', breaking ties alphabetically.
+func SortBy(scores []Score, metric Metric) {
+	sort.SliceStable(scores, func(i, j int) bool {
+		a, b := scores[i].Get(metric), scores[j].Get(metric)
+		if a != b {
+			return a > b
+		}
+		return scores[i].Word < scores[j].Word
+	})
+}
+
+// Writes 'scores' as CSV, with a header line.
+func WriteCSV(out io.Writer, scores []Score) error {
+	w := csv.NewWriter(out)
+	header := append([]string{"word", "study_count", "reference_count"},
+		metricNames...)
+	if err := w.Write(header); err != nil {
+		return err
+	}
+	for _, score := range scores {
+		record := []string{
+			score.Word,
+			strconv.FormatInt(score.StudyCount, 10),
+			strconv.FormatInt(score.ReferenceCount, 10),
+		}
+		for i := range metricNames {
+			record = append(record,
+				strconv.FormatFloat(score.Get(Metric(i)), 'g', 6, 64))
+		}
+		if err := w.Write(record); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// HELPERS
+
+func (self *Score) compute(studyTotal, referenceTotal float64) {
+	a := float64(self.StudyCount)
+	b := float64(self.ReferenceCount)
+	total := studyTotal + referenceTotal
+
+	// Expected counts, if the word were equally frequent in both corpora.
+	expectedA := studyTotal * (a + b) / total
+	expectedB := referenceTotal * (a + b) / total
+	g2 := 2 * (xLogXOverY(a, expectedA) + xLogXOverY(b, expectedB))
+
+	// The 2x2 table is [[a, b], [c, d]], where the second row counts all
+	// other words.
+	c := studyTotal - a
+	d := referenceTotal - b
+	chi2 := 0.0
+	denominator := (a + b) * (c + d) * studyTotal * referenceTotal
+	if denominator > 0 {
+		chi2 = total * (a*d - b*c) * (a*d - b*c) / denominator
+	}
+
+	studyFreq := a / studyTotal
+	referenceFreq := b / referenceTotal
+	if studyFreq < referenceFreq {
+		g2, chi2 = -g2, -chi2
+	}
+	self.LogLikelihood = g2
+	self.ChiSquare = chi2
+
+	if referenceFreq == 0 {
+		self.PercentDiff = math.Inf(1)
+	} else {
+		self.PercentDiff = (studyFreq - referenceFreq) * 100 / referenceFreq
+	}
+
+	self.LogRatio = math.Log2((math.Max(a, 0.5) / studyTotal) /
+		(math.Max(b, 0.5) / referenceTotal))
+}
+
+// Returns x * ln(x / y), taking 0 * ln(0) to be 0.
+func xLogXOverY(x, y float64) float64 {
+	if x == 0 {
+		return 0
+	}
+	return x * math.Log(x/y)
+}
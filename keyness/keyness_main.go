@@ -0,0 +1,94 @@
+// Tool for comparing a study corpus with a reference corpus. Writes a CSV
+// report with keyness statistics for every word to stdout.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"github.com/sethpollen/dorkalonius"
+	"github.com/sethpollen/dorkalonius/keyness"
+	"github.com/sethpollen/dorkalonius/util"
+	"log"
+	"os"
+	"strings"
+)
+
+// Files ending in .csv are read as counter_main output (word and count
+// columns, with no header). Other files are read as serialized WordSets.
+var studyFile = flag.String("study", "",
+	"Word counts for the study corpus")
+var referenceFile = flag.String("reference", "",
+	"Word counts for the reference corpus. If absent, the embedded COCA "+
+		"word set is used")
+var sortBy = flag.String("sort_by", "log_likelihood",
+	"Statistic to sort by, in descending order: one of log_likelihood, "+
+		"chi_square, percent_diff or log_ratio")
+var minCount = flag.Int64("min_count", 1,
+	"Omit words which occur fewer than this many times in the study corpus")
+
+func main() {
+	flag.Parse()
+
+	metric, err := keyness.ParseMetric(*sortBy)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	study := readWordSet(*studyFile)
+	var reference util.WordSet
+	if *referenceFile == "" {
+		coca, err := dorkalonius.Get_coca_word_set(context.Background())
+		if err != nil {
+			log.Fatalln(err)
+		}
+		reference = *coca
+	} else {
+		reference = readWordSet(*referenceFile)
+	}
+
+	scores, err := keyness.Compare(study, reference)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	kept := scores[:0]
+	for _, score := range scores {
+		if score.StudyCount >= *minCount {
+			kept = append(kept, score)
+		}
+	}
+	keyness.SortBy(kept, metric)
+
+	out := bufio.NewWriter(os.Stdout)
+	if err = keyness.WriteCSV(out, kept); err != nil {
+		log.Fatalln(err)
+	}
+	if err = out.Flush(); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func readWordSet(filename string) util.WordSet {
+	in, err := os.Open(filename)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer in.Close()
+
+	if strings.HasSuffix(filename, ".csv") {
+		format := util.CSVFormat{Comma: ',', WordColumn: 0, WeightColumn: 1,
+			PosColumn: -1, RankColumn: -1, DispersionColumn: -1}
+		wordSet, err := util.ReadCSV(bufio.NewReader(in), format, false)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return wordSet
+	}
+
+	wordSet, err := util.DeserializeWordSet(bufio.NewReader(in))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return *wordSet
+}
@@ -0,0 +1,103 @@
+package keyness_test
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+)
+import . "github.com/sethpollen/dorkalonius/keyness"
+import "github.com/sethpollen/dorkalonius/util"
+
+func newCorpus(counts map[string]int64) util.WordSet {
+	w := util.NewWordSet()
+	for word, count := range counts {
+		w.Add(util.WeightedWord{Word: word, Weight: count})
+	}
+	return w
+}
+
+func approxEqual(a, b float64) bool {
+	return math.Abs(a-b) < 1e-6 || (math.IsInf(a, 1) && math.IsInf(b, 1))
+}
+
+func TestCompare(t *testing.T) {
+	study := newCorpus(map[string]int64{"x": 10, "s": 990})
+	reference := newCorpus(map[string]int64{"x": 5, "y": 20, "r": 1975})
+
+	scores, err := Compare(study, reference)
+	if err != nil {
+		t.Fatal(err)
+	}
+	words := make([]string, len(scores))
+	for i, score := range scores {
+		words[i] = score.Word
+	}
+	if strings.Join(words, " ") != "r s x y" {
+		t.Fatalf("Wrong words: %v", words)
+	}
+
+	x := scores[2]
+	if x.StudyCount != 10 || x.ReferenceCount != 5 ||
+		!approxEqual(x.LogLikelihood, 6.931471805599453) ||
+		!approxEqual(x.ChiSquare, 7.5376884422110555) ||
+		!approxEqual(x.PercentDiff, 300) ||
+		!approxEqual(x.LogRatio, 2) {
+		t.Errorf("Wrong score for x: %+v", x)
+	}
+
+	y := scores[3]
+	if y.StudyCount != 0 || y.ReferenceCount != 20 ||
+		!approxEqual(y.LogLikelihood, -16.218604324326577) ||
+		!approxEqual(y.ChiSquare, -10.06711409395973) ||
+		!approxEqual(y.PercentDiff, -100) ||
+		!approxEqual(y.LogRatio, -4.321928094887363) {
+		t.Errorf("Wrong score for y: %+v", y)
+	}
+
+	if s := scores[1]; !math.IsInf(s.PercentDiff, 1) {
+		t.Errorf("Expected infinite %%DIFF for s: %+v", s)
+	}
+
+	if _, err := Compare(study, util.NewWordSet()); err == nil {
+		t.Error("Expected an error for an empty reference corpus")
+	}
+}
+
+func TestSortAndExport(t *testing.T) {
+	study := newCorpus(map[string]int64{"a": 50, "b": 10, "c": 40})
+	reference := newCorpus(map[string]int64{"a": 10, "b": 10, "c": 80})
+	scores, err := Compare(study, reference)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"log_likelihood", "chi_square",
+		"percent_diff", "log_ratio"} {
+		metric, err := ParseMetric(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if metric.String() != name {
+			t.Errorf("Expected %q, got %q", name, metric.String())
+		}
+		SortBy(scores, metric)
+		if scores[0].Word != "a" || scores[2].Word != "c" {
+			t.Errorf("Bad order by %s: %+v", name, scores)
+		}
+	}
+	if _, err := ParseMetric("bogus"); err == nil {
+		t.Error("Expected an error for an unknown metric")
+	}
+
+	var buf bytes.Buffer
+	if err := WriteCSV(&buf, scores[:1]); err != nil {
+		t.Fatal(err)
+	}
+	expected := "word,study_count,reference_count,log_likelihood,chi_square," +
+		"percent_diff,log_ratio\n" +
+		"a,50,10,29.1103,38.0952,400,2.32193\n"
+	if buf.String() != expected {
+		t.Errorf("Expected:\n%s\nGot:\n%s", expected, buf.String())
+	}
+}
@@ -0,0 +1,50 @@
+// Looks up words in the embedded COCA word set, suggesting corrections for
+// words which aren't in it. Words to look up are passed as plain
+// command-line arguments.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/sethpollen/dorkalonius"
+	"github.com/sethpollen/dorkalonius/util"
+	"log"
+	"strings"
+)
+
+var maxDistance = flag.Int("max_distance", 2,
+	"Largest edit distance at which to suggest a word.")
+var maxSuggestions = flag.Int("max_suggestions", 5,
+	"Number of suggestions to print for each word. Zero means no limit.")
+
+func main() {
+	flag.Parse()
+
+	wordSet, err := dorkalonius.Get_coca_word_set(context.Background())
+	if err != nil {
+		log.Fatalln(err)
+	}
+	index := util.NewFuzzyIndex(*wordSet)
+	for _, word := range flag.Args() {
+		// The COCA words are all lowercase.
+		matches := index.Lookup(strings.ToLower(word), *maxDistance)
+		if len(matches) > 0 && matches[0].Distance == 0 {
+			fmt.Printf("%s: found (%d)\n", word, matches[0].Word.Weight)
+			continue
+		}
+		if len(matches) == 0 {
+			fmt.Printf("%s: not found\n", word)
+			continue
+		}
+		if *maxSuggestions > 0 && len(matches) > *maxSuggestions {
+			matches = matches[:*maxSuggestions]
+		}
+		fmt.Printf("%s: not found; did you mean:\n", word)
+		for _, match := range matches {
+			fmt.Printf("  %s (distance %d, %d)\n", match.Word.Word,
+				match.Distance, match.Word.Weight)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+// Timed rounds of the game. Each round runs through a fixed sequence of
+// phases, and each phase ends when its timer expires.
+
+package dorkalonius
+
+import (
+	"context"
+	"fmt"
+	"github.com/sethpollen/dorkalonius/util"
+	"sync"
+	"time"
+)
+
+type Phase int
+
+const (
+	// Players write using the available words.
+	PhaseWriting Phase = iota
+	// Players read their writing aloud.
+	PhaseReading
+	// Players vote on the best writing.
+	PhaseVoting
+	// The round is over.
+	PhaseDone
+)
+
+func (self Phase) String() string {
+	switch self {
+	case PhaseWriting:
+		return "writing"
+	case PhaseReading:
+		return "reading"
+	case PhaseVoting:
+		return "voting"
+	case PhaseDone:
+		return "done"
+	}
+	return fmt.Sprintf("Phase(%d)", int(self))
+}
+
+type RoundConfig struct {
+	// How long each phase lasts. Phases with no duration are skipped.
+	WritingDuration time.Duration
+	ReadingDuration time.Duration
+	VotingDuration  time.Duration
+
+	// Remaining times in each phase at which to send TimerWarning events.
+	Warnings []time.Duration
+	// Interval between TimerTick events. Zero disables them.
+	TickInterval time.Duration
+}
+
+// A timer event from one of the round's phases.
+type RoundEvent struct {
+	Phase Phase
+	Timer util.TimerEvent
+}
+
+type Round struct {
+	config RoundConfig
+	clock  util.Clock
+
+	mutex sync.Mutex
+	// The current phase, once the round has started.
+	phase Phase
+	// The current phase's timer, or nil if the round hasn't started or is
+	// over.
+	timer       *util.Timer
+	subscribers []func(event RoundEvent)
+}
+
+func NewRound(config RoundConfig, clock util.Clock) *Round {
+	return &Round{config: config, clock: clock}
+}
+
+// Registers 'f' to receive the events from every phase's timer. Events are
+// delivered on the goroutine which called Run.
+func (self *Round) Subscribe(f func(event RoundEvent)) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.subscribers = append(self.subscribers, f)
+}
+
+// Runs each phase in turn until the round is over or 'ctx' is done. Returns
+// nil if the round finished, or ctx.Err().
+func (self *Round) Run(ctx context.Context) error {
+	for _, phase := range self.phases() {
+		phase := phase
+		timer := util.NewTimer(self.clock, self.duration(phase),
+			self.config.Warnings, self.config.TickInterval)
+		timer.Subscribe(func(event util.TimerEvent) {
+			self.notify(RoundEvent{phase, event})
+		})
+
+		self.mutex.Lock()
+		self.phase = phase
+		self.timer = timer
+		self.mutex.Unlock()
+
+		if err := timer.Run(ctx); err != nil {
+			return err
+		}
+	}
+
+	self.mutex.Lock()
+	self.phase = PhaseDone
+	self.timer = nil
+	self.mutex.Unlock()
+	return nil
+}
+
+// Returns the current phase and the time left in it.
+func (self *Round) Status() (Phase, time.Duration) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.timer != nil {
+		return self.phase, self.timer.Remaining()
+	}
+	if self.phase != PhaseDone {
+		// The round hasn't started yet.
+		if phases := self.phases(); len(phases) > 0 {
+			return phases[0], self.duration(phases[0])
+		}
+	}
+	return PhaseDone, 0
+}
+
+// Pauses the current phase's timer.
+func (self *Round) Pause() {
+	if timer := self.currentTimer(); timer != nil {
+		timer.Pause()
+	}
+}
+
+func (self *Round) Resume() {
+	if timer := self.currentTimer(); timer != nil {
+		timer.Resume()
+	}
+}
+
+// Adds 'd' to the current phase.
+func (self *Round) Extend(d time.Duration) {
+	if timer := self.currentTimer(); timer != nil {
+		timer.Extend(d)
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// HELPERS
+
+// Returns the phases which will be run, in order.
+func (self *Round) phases() []Phase {
+	var phases []Phase
+	for _, phase := range []Phase{PhaseWriting, PhaseReading, PhaseVoting} {
+		if self.duration(phase) > 0 {
+			phases = append(phases, phase)
+		}
+	}
+	return phases
+}
+
+func (self *Round) duration(phase Phase) time.Duration {
+	switch phase {
+	case PhaseWriting:
+		return self.config.WritingDuration
+	case PhaseReading:
+		return self.config.ReadingDuration
+	case PhaseVoting:
+		return self.config.VotingDuration
+	}
+	return 0
+}
+
+func (self *Round) currentTimer() *util.Timer {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.timer
+}
+
+func (self *Round) notify(event RoundEvent) {
+	self.mutex.Lock()
+	subscribers := self.subscribers
+	self.mutex.Unlock()
+	for _, f := range subscribers {
+		f(event)
+	}
+}
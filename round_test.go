@@ -0,0 +1,106 @@
+package dorkalonius_test
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+import . "github.com/sethpollen/dorkalonius"
+import "github.com/sethpollen/dorkalonius/util"
+
+// Waits for the round's timer to block on 'clock'.
+func awaitWaiter(t *testing.T, clock *util.FakeClock) {
+	for i := 0; clock.Waiters() == 0; i++ {
+		if i > 1000 {
+			t.Fatalf("Round never waited on the clock")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func checkStatus(t *testing.T, round *Round, phase Phase,
+	remaining time.Duration) {
+	actualPhase, actualRemaining := round.Status()
+	if actualPhase != phase || actualRemaining != remaining {
+		t.Errorf("Expected %v with %v left; got %v with %v left",
+			phase, remaining, actualPhase, actualRemaining)
+	}
+}
+
+func TestRound(t *testing.T) {
+	clock := util.NewFakeClock(time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC))
+	round := NewRound(RoundConfig{
+		WritingDuration: 3 * time.Minute,
+		VotingDuration:  time.Minute,
+		Warnings:        []time.Duration{10 * time.Second},
+	}, clock)
+	var mutex sync.Mutex
+	var events []string
+	round.Subscribe(func(event RoundEvent) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		events = append(events,
+			event.Phase.String()+" "+event.Timer.Kind.String())
+	})
+	checkStatus(t, round, PhaseWriting, 3*time.Minute)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- round.Run(context.Background())
+	}()
+	awaitWaiter(t, clock)
+	clock.Advance(time.Minute)
+	awaitWaiter(t, clock)
+	checkStatus(t, round, PhaseWriting, 2*time.Minute)
+
+	// The reading phase has no duration, so it is skipped.
+	clock.Advance(2 * time.Minute)
+	awaitWaiter(t, clock)
+	checkStatus(t, round, PhaseVoting, time.Minute)
+
+	round.Extend(30 * time.Second)
+	clock.Advance(80 * time.Second)
+	awaitWaiter(t, clock)
+	checkStatus(t, round, PhaseVoting, 10*time.Second)
+
+	clock.Advance(10 * time.Second)
+	if err := <-done; err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	checkStatus(t, round, PhaseDone, 0)
+
+	expected := []string{
+		"writing started",
+		"writing warning",
+		"writing expired",
+		"voting started",
+		"voting extended",
+		"voting warning",
+		"voting expired",
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("Expected events %v; got %v", expected, events)
+	}
+}
+
+func TestRoundCancel(t *testing.T) {
+	clock := util.NewFakeClock(time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC))
+	round := NewRound(RoundConfig{ReadingDuration: time.Minute}, clock)
+	checkStatus(t, round, PhaseReading, time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- round.Run(ctx)
+	}()
+	awaitWaiter(t, clock)
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Expected context.Canceled; got %v", err)
+	}
+	checkStatus(t, round, PhaseReading, time.Minute)
+}
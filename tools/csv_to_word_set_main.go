@@ -3,19 +3,24 @@
 package main
 
 import (
-	"encoding/csv"
+	"context"
 	"flag"
+	"fmt"
 	"github.com/sethpollen/dorkalonius/util"
-	"io"
 	"log"
 	"os"
-	"strconv"
+	"runtime"
   "strings"
 )
 
 // Input files are passed as plain command-line arguments.
 var outputFile = flag.String("output_file", "",
 	"Serialized WordSet file to write")
+var outputFlat = flag.Bool("output_flat", false,
+	"If true, write the flat layout read by util.MapFlatWordSet instead of "+
+		"the format read by util.DeserializeWordSet")
+var parallelism = flag.Int("parallelism", runtime.NumCPU(),
+	"Maximum number of input files to read at once")
 
 // CSV interpretation settings.
 var csvHeaderLines = flag.Int("csv_header_lines", 0,
@@ -30,68 +35,89 @@ var csvFilterColumn = flag.Int("csv_filter_column", -1,
 var csvFilterValue = flag.String("csv_filter_value", "",
   "We only keep rows where the csv_filter_column has this value")
 
+// Optional word attribute columns. Leave absent to omit an attribute.
+var csvPosColumn = flag.Int("csv_pos_column", -1,
+	"Column in the CSV file which contains the part of speech")
+var csvRankColumn = flag.Int("csv_rank_column", -1,
+	"Column in the CSV file which contains the frequency rank")
+var csvDispersionColumn = flag.Int("csv_dispersion_column", -1,
+	"Column in the CSV file which contains the dispersion")
+var csvCompositeKeys = flag.Bool("csv_composite_keys", false,
+	"If true, key words by (word, part of speech), so that homographs are "+
+		"kept apart. Requires --csv_pos_column")
+
 func main() {
 	flag.Parse()
 
-	tasks := make([]func() util.WordSet, flag.NArg())
+	if *csvCompositeKeys && *csvPosColumn < 0 {
+		log.Fatalln("--csv_composite_keys requires --csv_pos_column")
+	}
+
+	tasks := make([]util.WordSetTask, flag.NArg())
 	for i := range tasks {
 		filename := flag.Arg(i)
-		tasks[i] = func() util.WordSet {
-			return readFile(filename)
+		tasks[i] = util.WordSetTask{
+			Name: filename,
+			Run: func(ctx context.Context) (util.WordSet, error) {
+				return readFile(filename)
+			},
 		}
 	}
-	wordSet := util.BuildWordSet(tasks)
+	wordSet, err := util.BuildWordSetContext(context.Background(), tasks,
+		*parallelism, nil)
+	if err != nil {
+		log.Fatalln(err)
+	}
 
 	out, err := os.Create(*outputFile)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	err = wordSet.Serialize(out)
+	if *outputFlat {
+		err = wordSet.WriteFlat(out)
+	} else {
+		err = wordSet.Serialize(out)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
-func readFile(filename string) util.WordSet {
+func readFile(filename string) (util.WordSet, error) {
 	in, err := os.Open(filename)
 	if err != nil {
-		log.Fatal(err)
+		return util.NewWordSet(), err
 	}
+	defer in.Close()
 
-	csvIn := csv.NewReader(in)
-	// Disable field count checking.
-	csvIn.FieldsPerRecord = -1
-
-	wordSet := util.NewWordSet()
-
-	for i := 0; true; i++ {
-		record, err := csvIn.Read()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			log.Fatalln(err)
-		}
-		if i < *csvHeaderLines {
-			continue
-		}
-		
-		if *csvFilterColumn >= 0 {
-      if record[*csvFilterColumn] != *csvFilterValue {
-        continue
-      }
-    }
-
-		word := record[*csvWordColumn]
-		word = strings.ToLower(word)
-		weight, err := strconv.ParseInt(record[*csvWeightColumn], 10, 64)
-		if err != nil {
-			log.Fatal(err)
+	format := util.CSVFormat{
+		Comma:            ',',
+		HeaderLines:      *csvHeaderLines,
+		WordColumn:       *csvWordColumn,
+		WeightColumn:     *csvWeightColumn,
+		PosColumn:        *csvPosColumn,
+		RankColumn:       *csvRankColumn,
+		DispersionColumn: *csvDispersionColumn,
+	}
+	if *csvFilterColumn >= 0 {
+		format.Filter = func(record []string) bool {
+			return *csvFilterColumn < len(record) &&
+				record[*csvFilterColumn] == *csvFilterValue
 		}
-
-		wordSet.Add(util.WeightedWord{word, weight})
+	}
+	wordSet, err := util.ReadCSV(in, format, *csvCompositeKeys)
+	if err != nil {
+		return util.NewWordSet(), fmt.Errorf("%s: %v", filename, err)
 	}
 
-	return wordSet
+	// Lowercase the words, merging any which differ only in case.
+	words := wordSet.GetWords()
+	for i := range words {
+		words[i].Word = strings.ToLower(words[i].Word)
+	}
+	if *csvCompositeKeys {
+		return util.NewCompositeWordSetFromSlice(words)
+	}
+	return util.NewWordSetFromSlice(words)
 }
@@ -37,11 +37,24 @@ def word_set(
   csv_weight_column=1,
   csv_filter_column=None,
   csv_filter_value=None,
+  csv_pos_column=None,
+  csv_rank_column=None,
+  csv_dispersion_column=None,
+  csv_composite_keys=False,
 ):
   filter_flags = ""
   if csv_filter_column and csv_filter_value:
     filter_flags = "--csv_filter_column=%d --csv_filter_value=%s" % (
         csv_filter_column, csv_filter_value)
+  attribute_flags = ""
+  if csv_pos_column != None:
+    attribute_flags += " --csv_pos_column=%d" % csv_pos_column
+  if csv_rank_column != None:
+    attribute_flags += " --csv_rank_column=%d" % csv_rank_column
+  if csv_dispersion_column != None:
+    attribute_flags += " --csv_dispersion_column=%d" % csv_dispersion_column
+  if csv_composite_keys:
+    attribute_flags += " --csv_composite_keys"
   native.genrule(
     name = name + "__wordset",
     srcs = srcs,
@@ -52,6 +65,7 @@ def word_set(
           "  --csv_word_column=" + str(csv_word_column) +
           "  --csv_weight_column=" + str(csv_weight_column) +
           "  " + filter_flags +
+          "  " + attribute_flags +
           "  $(SRCS)",
     tools = ["//tools:csv_to_word_set_main"],
   )
@@ -60,21 +74,25 @@ def word_set(
     data = [":" + name + "__wordset"],
     package = package,
   )
-  # We emit another .go file to handle deserializing and memoizing the WordSet.
+  # We emit another .go file to handle deserializing the WordSet. Get_<name>
+  # memoizes it in 'wordSets', which the package must declare with
+  # util.NewWordSetCache, mapping 'name' to Load_<name>. The accessors return
+  # errors rather than exiting, so that each binary can decide how to handle
+  # a corrupt embedded set.
   go_lib_source = " ; ".join([
     'package %s' % package,
+    'import "context"',
+    'import "fmt"',
     'import "github.com/sethpollen/dorkalonius/util"',
-    'import "log"',
-    'var %s_memo = util.NewMemo(func() interface{} {' % name,
-    'in := Get_%s__embed()' % name,
-    'wordSet, err := util.DeserializeWordSet(in)',
+    'func Load_%s(ctx context.Context) (*util.WordSet, error) {' % name,
+    'wordSet, err := util.DeserializeWordSet(Get_%s__embed())' % name,
     'if err != nil {',
-    'log.Fatal("Failed to load %s: ", err)' % name,
+    'return nil, fmt.Errorf("Failed to load %s: %%v", err)' % name,
     '}',
-    'return wordSet',
-    '})',
-    'func Get_%s() *util.WordSet {' % name,
-    'return %s_memo.Get().(*util.WordSet)' % name,
+    'return wordSet, nil',
+    '}',
+    'func Get_%s(ctx context.Context) (*util.WordSet, error) {' % name,
+    'return wordSets.Get(ctx, "%s")' % name,
     '}',
   ])
   native.genrule(
@@ -0,0 +1,51 @@
+// Tool for converting a serialized WordSet into CSV, TSV or JSON, so that it
+// can be inspected, diffed or fed to other tools.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"github.com/sethpollen/dorkalonius/util"
+	"log"
+	"os"
+)
+
+var inputFile = flag.String("input_file", "",
+	"Serialized WordSet file to read")
+var format = flag.String("format", "csv",
+	"Output format: one of csv, tsv or json")
+
+func main() {
+	flag.Parse()
+
+	in, err := os.Open(*inputFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	wordSet, err := util.DeserializeWordSet(bufio.NewReader(in))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	switch *format {
+	case "csv":
+		err = wordSet.WriteCSV(out, util.NewCSVFormat())
+	case "tsv":
+		err = wordSet.WriteCSV(out, util.NewTSVFormat())
+	case "json":
+		var text []byte
+		text, err = wordSet.MarshalJSON()
+		if err == nil {
+			_, err = out.Write(append(text, '\n'))
+		}
+	default:
+		log.Fatalln("Unknown --format:", *format)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
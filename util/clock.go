@@ -0,0 +1,84 @@
+// Clocks, so that code which waits can be tested without real delays.
+
+package util
+
+import (
+	"sync"
+	"time"
+)
+
+type Clock interface {
+	Now() time.Time
+	// Returns a channel which receives the current time once 'd' has passed.
+	After(d time.Duration) <-chan time.Time
+}
+
+// The real system clock.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (self systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (self systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// A Clock which only moves when Advance is called.
+type FakeClock struct {
+	mutex   sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	deadline time.Time
+	c        chan time.Time
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (self *FakeClock) Now() time.Time {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.now
+}
+
+func (self *FakeClock) After(d time.Duration) <-chan time.Time {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	c := make(chan time.Time, 1)
+	if d <= 0 {
+		c <- self.now
+	} else {
+		self.waiters = append(self.waiters, fakeWaiter{self.now.Add(d), c})
+	}
+	return c
+}
+
+// Moves the clock forward by 'd', firing any After channels which come due.
+func (self *FakeClock) Advance(d time.Duration) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.now = self.now.Add(d)
+	pending := self.waiters[:0]
+	for _, waiter := range self.waiters {
+		if waiter.deadline.After(self.now) {
+			pending = append(pending, waiter)
+		} else {
+			waiter.c <- self.now
+		}
+	}
+	self.waiters = pending
+}
+
+// Returns the number of After channels which have not fired yet.
+func (self *FakeClock) Waiters() int {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return len(self.waiters)
+}
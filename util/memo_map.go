@@ -0,0 +1,247 @@
+// A keyed version of Memo, for programs which load many named objects (like
+// corpora) on demand but can't keep all of them in memory.
+
+package util
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Bounds on what a MemoMap keeps. Zero fields mean no bound.
+type MemoMapLimits[V any] struct {
+	// Most entries to keep.
+	MaxEntries int
+
+	// Most total cost to keep, as measured by Cost.
+	MaxCost int64
+
+	// Estimates the cost of keeping 'value', such as its size in bytes.
+	// Required if MaxCost is set.
+	Cost func(value V) int64
+}
+
+// Counters describing a MemoMap's activity.
+type MemoMapStats struct {
+	// Calls to Get answered without running the loader, including those
+	// which waited for another call's load.
+	Hits int64
+	// Calls to Get which ran the loader.
+	Misses int64
+	// Loads which returned an error.
+	LoadErrors int64
+	// Entries dropped to stay within the limits.
+	Evictions int64
+	// Total time spent in the loader.
+	LoadTime time.Duration
+
+	// Current number and total cost of the memoized entries.
+	Entries int
+	Cost    int64
+}
+
+// Memoizes a result of type V for each key of type K. Each result is loaded
+// on first use, and concurrent calls for the same key share a single load.
+// Failed loads are not memoized. When the limits are exceeded, the least
+// recently used entries are evicted, but the most recently used entry is
+// always kept.
+type MemoMap[K comparable, V any] struct {
+	mutex  sync.Mutex
+	load   func(ctx context.Context, key K) (V, error)
+	limits MemoMapLimits[V]
+
+	entries map[K]*memoEntry[K, V]
+	// Loaded entries, most recently used first.
+	recent *list.List
+	stats  MemoMapStats
+}
+
+type memoEntry[K comparable, V any] struct {
+	key   K
+	value V
+	cost  int64
+
+	// Closed once the entry's load finishes.
+	loading chan struct{}
+	// This entry's element in MemoMap.recent, once it is loaded.
+	element *list.Element
+}
+
+func NewMemoMap[K comparable, V any](
+	load func(ctx context.Context, key K) (V, error),
+	limits MemoMapLimits[V]) *MemoMap[K, V] {
+	return &MemoMap[K, V]{
+		load:    load,
+		limits:  limits,
+		entries: make(map[K]*memoEntry[K, V]),
+		recent:  list.New(),
+	}
+}
+
+// Loads a single WordSet, such as an embedded corpus.
+type WordSetLoader func(ctx context.Context) (*WordSet, error)
+
+// Estimates the memory a WordSet holds, in bytes, for use as
+// MemoMapLimits.Cost. This is the per-node overhead times Size(), plus the
+// bytes of the words and their parts of speech (see WordSet.MemoryUsage).
+func WordSetCost(wordSet *WordSet) int64 {
+	return wordSet.MemoryUsage()
+}
+
+// Builds a MemoMap which loads each WordSet by name, using the matching
+// entry of 'loaders'. Once the loaded sets are estimated (by WordSetCost) to
+// hold more than 'maxBytes', the least recently used are evicted; zero means
+// no bound. Callers which keep an evicted set alive still hold its memory,
+// and the next Get for its name loads a new copy.
+func NewWordSetCache(loaders map[string]WordSetLoader,
+	maxBytes int64) *MemoMap[string, *WordSet] {
+	// Copy the loaders, so that later changes to 'loaders' aren't seen.
+	byName := make(map[string]WordSetLoader, len(loaders))
+	for name, load := range loaders {
+		byName[name] = load
+	}
+	return NewMemoMap(func(ctx context.Context, name string) (*WordSet, error) {
+		load, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown word set: %q", name)
+		}
+		return load(ctx)
+	}, MemoMapLimits[*WordSet]{MaxCost: maxBytes, Cost: WordSetCost})
+}
+
+// Fetches the result for 'key', loading it if necessary. 'ctx' is passed to
+// the loader if this call runs it. Returns ctx.Err() if 'ctx' is done while
+// waiting for another call's load.
+func (self *MemoMap[K, V]) Get(ctx context.Context, key K) (V, error) {
+	for {
+		self.mutex.Lock()
+		entry, ok := self.entries[key]
+		if !ok {
+			return self.runLoad(ctx, key)
+		}
+		if entry.element != nil {
+			self.stats.Hits++
+			self.recent.MoveToFront(entry.element)
+			value := entry.value
+			self.mutex.Unlock()
+			return value, nil
+		}
+		self.mutex.Unlock()
+
+		select {
+		case <-entry.loading:
+			// Either the result is now memoized or the load failed. Check again.
+		case <-ctx.Done():
+			var zero V
+			return zero, ctx.Err()
+		}
+	}
+}
+
+// Forgets the result for 'key', so that the next call to Get loads it again.
+// A load already in progress still returns its result to its caller, but
+// doesn't memoize it.
+func (self *MemoMap[K, V]) Invalidate(key K) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if entry, ok := self.entries[key]; ok {
+		self.remove(entry)
+	}
+}
+
+// Forgets every result.
+func (self *MemoMap[K, V]) Clear() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	for _, entry := range self.entries {
+		self.remove(entry)
+	}
+}
+
+// Returns a snapshot of the counters.
+func (self *MemoMap[K, V]) Stats() MemoMapStats {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	stats := self.stats
+	stats.Entries = self.recent.Len()
+	return stats
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// HELPERS
+
+// Runs the loader for 'key'. Must be called with the mutex held; releases
+// it.
+func (self *MemoMap[K, V]) runLoad(ctx context.Context,
+	key K) (value V, err error) {
+	entry := &memoEntry[K, V]{key: key, loading: make(chan struct{})}
+	self.entries[key] = entry
+	self.stats.Misses++
+	self.mutex.Unlock()
+
+	start := time.Now()
+	// Wake up any waiters, even if the loader panics.
+	defer func() {
+		self.mutex.Lock()
+		self.stats.LoadTime += time.Since(start)
+		if err != nil {
+			self.stats.LoadErrors++
+		}
+		// If the result wasn't memoized (because the load failed or panicked),
+		// let the next call try again.
+		if entry.element == nil && self.entries[key] == entry {
+			delete(self.entries, key)
+		}
+		self.mutex.Unlock()
+		close(entry.loading)
+	}()
+
+	value, err = self.load(ctx, key)
+	if err != nil {
+		return value, err
+	}
+	var cost int64 = 0
+	if self.limits.Cost != nil {
+		cost = self.limits.Cost(value)
+	}
+
+	self.mutex.Lock()
+	// Only memoize the result if the entry wasn't invalidated meanwhile.
+	if self.entries[key] == entry {
+		entry.value = value
+		entry.cost = cost
+		entry.element = self.recent.PushFront(entry)
+		self.stats.Cost += entry.cost
+		self.evict()
+	}
+	self.mutex.Unlock()
+	return value, nil
+}
+
+// Evicts the least recently used entries until the limits are met or only
+// one entry is left. Must be called with the mutex held.
+func (self *MemoMap[K, V]) evict() {
+	for self.recent.Len() > 1 {
+		overEntries := self.limits.MaxEntries > 0 &&
+			self.recent.Len() > self.limits.MaxEntries
+		overCost := self.limits.MaxCost > 0 &&
+			self.stats.Cost > self.limits.MaxCost
+		if !overEntries && !overCost {
+			return
+		}
+		self.remove(self.recent.Back().Value.(*memoEntry[K, V]))
+		self.stats.Evictions++
+	}
+}
+
+// Must be called with the mutex held.
+func (self *MemoMap[K, V]) remove(entry *memoEntry[K, V]) {
+	delete(self.entries, entry.key)
+	if entry.element != nil {
+		self.recent.Remove(entry.element)
+		self.stats.Cost -= entry.cost
+	}
+}
@@ -2,36 +2,117 @@
 
 package util
 
-// Memoizes a single result. This struct consists solely of a channel used
-// to communicate requests to a worker goroutine.
-type Memo struct {
-	requestChan chan<- chan<- interface{}
+import (
+	"context"
+	"sync"
+)
+
+// Memoizes a single result of type T. The result is loaded lazily, by the
+// first call to Get. Failed loads are not memoized, so the next call to Get
+// tries again.
+type Memo[T any] struct {
+	mutex sync.Mutex
+	load  func(ctx context.Context) (T, error)
+
+	// The memoized result, valid iff 'loaded' is true.
+	value  T
+	loaded bool
+
+	// Non-nil while a load is in progress. Closed when that load finishes.
+	loading chan struct{}
+
+	// Incremented by Invalidate and Reset, so that loads which started before
+	// then don't memoize their results.
+	generation int64
+}
+
+func NewMemo[T any](load func(ctx context.Context) (T, error)) *Memo[T] {
+	return &Memo[T]{load: load}
+}
+
+// Fetches the memoized result, loading it if necessary. 'ctx' is passed to
+// the loader if this call runs it. Concurrent calls share a single load; if
+// it fails, the caller which ran it gets the error and the others try again.
+// Returns ctx.Err() if 'ctx' is done while waiting for another call's load.
+func (self *Memo[T]) Get(ctx context.Context) (T, error) {
+	for {
+		self.mutex.Lock()
+		if self.loaded {
+			value := self.value
+			self.mutex.Unlock()
+			return value, nil
+		}
+		if self.loading == nil {
+			return self.runLoad(ctx)
+		}
+		loading := self.loading
+		self.mutex.Unlock()
+
+		select {
+		case <-loading:
+			// Either the result is now memoized or the load failed. Check again.
+		case <-ctx.Done():
+			var zero T
+			return zero, ctx.Err()
+		}
+	}
 }
 
-func NewMemo(f func() interface{}) Memo {
-	requestChan := make(chan chan<- interface{})
-	go worker(f, requestChan)
-	return Memo{requestChan}
+// Forgets the memoized result, so that the next call to Get loads it again.
+// Loads already in progress still return their results to their callers, but
+// don't memoize them.
+func (self *Memo[T]) Invalidate() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.invalidate()
 }
 
-// Fetches the memoized object.
-func (self Memo) Get() interface{} {
-	response := make(chan interface{})
-	self.requestChan <- response
-	return <-response
+// Like Invalidate, but also replaces the loader.
+func (self *Memo[T]) Reset(load func(ctx context.Context) (T, error)) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.invalidate()
+	self.load = load
 }
 
-// The worker goroutine.
-func worker(f func() interface{}, requestChan chan chan<- interface{}) {
-	var called bool = false
-	var result interface{} = nil
+///////////////////////////////////////////////////////////////////////////////
+// HELPERS
+
+// Runs the loader. Must be called with the mutex held; releases it.
+func (self *Memo[T]) runLoad(ctx context.Context) (value T, err error) {
+	loading := make(chan struct{})
+	self.loading = loading
+	load := self.load
+	generation := self.generation
+	self.mutex.Unlock()
 
-	for response := range requestChan {
-		if !called {
-			// We construct the object lazily.
-			result = f()
-			called = true
+	// Wake up any waiters, even if the loader panics.
+	defer func() {
+		self.mutex.Lock()
+		if self.loading == loading {
+			self.loading = nil
 		}
-		response <- result
+		self.mutex.Unlock()
+		close(loading)
+	}()
+
+	value, err = load(ctx)
+	if err == nil {
+		self.mutex.Lock()
+		if generation == self.generation {
+			self.value = value
+			self.loaded = true
+		}
+		self.mutex.Unlock()
 	}
+	return value, err
+}
+
+// Must be called with the mutex held.
+func (self *Memo[T]) invalidate() {
+	var zero T
+	self.value = zero
+	self.loaded = false
+	self.loading = nil
+	self.generation++
 }
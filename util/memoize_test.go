@@ -1,23 +1,284 @@
 package util_test
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 import . "github.com/sethpollen/dorkalonius/util"
 
 func TestBasic(t *testing.T) {
 	var calls int = 0
-	m := NewMemo(func() interface{} {
+	m := NewMemo(func(ctx context.Context) (string, error) {
 		calls++
-		return "foo"
+		return "foo", nil
 	})
 	for i := 0; i < 2; i++ {
-		r := m.Get()
-		if r.(string) != "foo" {
-			t.Error(r)
+		r, err := m.Get(context.Background())
+		if err != nil || r != "foo" {
+			t.Error(r, err)
 		}
 	}
 	if calls != 1 {
 		t.Error(calls)
 	}
 }
+
+func TestRetryAfterError(t *testing.T) {
+	var calls int = 0
+	m := NewMemo(func(ctx context.Context) (int, error) {
+		calls++
+		if calls == 1 {
+			return 0, errors.New("failed")
+		}
+		return calls, nil
+	})
+	if _, err := m.Get(context.Background()); err == nil {
+		t.Error("Expected the first load to fail")
+	}
+	for i := 0; i < 2; i++ {
+		if r, err := m.Get(context.Background()); err != nil || r != 2 {
+			t.Error(r, err)
+		}
+	}
+	if calls != 2 {
+		t.Error(calls)
+	}
+}
+
+func TestInvalidateAndReset(t *testing.T) {
+	var calls int = 0
+	m := NewMemo(func(ctx context.Context) (int, error) {
+		calls++
+		return calls, nil
+	})
+	ctx := context.Background()
+	if r, _ := m.Get(ctx); r != 1 {
+		t.Error(r)
+	}
+	m.Invalidate()
+	if r, _ := m.Get(ctx); r != 2 {
+		t.Error(r)
+	}
+	if r, _ := m.Get(ctx); r != 2 {
+		t.Error(r)
+	}
+
+	m.Reset(func(ctx context.Context) (int, error) {
+		return 100, nil
+	})
+	if r, _ := m.Get(ctx); r != 100 {
+		t.Error(r)
+	}
+}
+
+func TestConcurrentGet(t *testing.T) {
+	var calls int = 0
+	release := make(chan struct{})
+	m := NewMemo(func(ctx context.Context) (string, error) {
+		calls++
+		<-release
+		return "foo", nil
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if r, err := m.Get(context.Background()); err != nil || r != "foo" {
+				t.Error(r, err)
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if calls != 1 {
+		t.Error(calls)
+	}
+}
+
+func TestCancelWhileWaiting(t *testing.T) {
+	release := make(chan struct{})
+	m := NewMemo(func(ctx context.Context) (string, error) {
+		<-release
+		return "foo", nil
+	})
+	go m.Get(context.Background())
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := m.Get(ctx); err != context.Canceled {
+		t.Error(err)
+	}
+	close(release)
+}
+
+func TestMemoMap(t *testing.T) {
+	var mutex sync.Mutex
+	calls := make(map[string]int)
+	m := NewMemoMap(func(ctx context.Context, key string) (string, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		calls[key]++
+		if key == "bad" {
+			return "", errors.New("failed")
+		}
+		return key + key, nil
+	}, MemoMapLimits[string]{MaxEntries: 2})
+	ctx := context.Background()
+
+	for _, key := range []string{"a", "b", "a", "c", "a", "b"} {
+		if r, err := m.Get(ctx, key); err != nil || r != key+key {
+			t.Error(r, err)
+		}
+	}
+	// "b" was evicted when "c" was loaded, since "a" was used more recently.
+	if calls["a"] != 1 || calls["b"] != 2 || calls["c"] != 1 {
+		t.Error(calls)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := m.Get(ctx, "bad"); err == nil {
+			t.Error("Expected an error")
+		}
+	}
+	if calls["bad"] != 2 {
+		t.Error(calls)
+	}
+
+	stats := m.Stats()
+	if stats.Hits != 2 || stats.Misses != 6 || stats.LoadErrors != 2 ||
+		stats.Evictions != 2 || stats.Entries != 2 {
+		t.Errorf("%+v", stats)
+	}
+
+	m.Invalidate("a")
+	m.Get(ctx, "a")
+	if calls["a"] != 2 {
+		t.Error(calls)
+	}
+	m.Clear()
+	if stats := m.Stats(); stats.Entries != 0 {
+		t.Errorf("%+v", stats)
+	}
+}
+
+func TestMemoMapCost(t *testing.T) {
+	m := NewMemoMap(func(ctx context.Context, size int) (*WordSet, error) {
+		w := NewWordSet()
+		for i := 0; i < size; i++ {
+			w.Add(WeightedWord{Word: fmt.Sprint(i), Weight: 1})
+		}
+		return &w, nil
+	}, MemoMapLimits[*WordSet]{
+		MaxCost: 15000,
+		Cost:    WordSetCost,
+	})
+	ctx := context.Background()
+
+	m.Get(ctx, 100)
+	m.Get(ctx, 10)
+	if stats := m.Stats(); stats.Entries != 2 || stats.Evictions != 0 {
+		t.Errorf("%+v", stats)
+	}
+	// This one is too big to keep alongside the others, but it is kept on
+	// its own.
+	w, err := m.Get(ctx, 1000)
+	if err != nil || w.Size() != 1000 {
+		t.Error(w, err)
+	}
+	stats := m.Stats()
+	if stats.Entries != 1 || stats.Evictions != 2 ||
+		stats.Cost != w.MemoryUsage() {
+		t.Errorf("%+v", stats)
+	}
+}
+
+func TestWordSetCache(t *testing.T) {
+	build := func(size int) *WordSet {
+		w := NewWordSet()
+		for i := 0; i < size; i++ {
+			w.Add(WeightedWord{Word: fmt.Sprint(i), Weight: 1})
+		}
+		return &w
+	}
+	var mutex sync.Mutex
+	loads := make(map[string]int)
+	loader := func(name string, size int) WordSetLoader {
+		return func(ctx context.Context) (*WordSet, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			loads[name]++
+			return build(size), nil
+		}
+	}
+	smallCost := WordSetCost(build(10))
+	largeCost := WordSetCost(build(1000))
+	if smallCost <= 0 || largeCost <= 10*smallCost {
+		t.Fatalf("Implausible costs: %d, %d", smallCost, largeCost)
+	}
+
+	// There is room for both small sets, or for the large one alone.
+	cache := NewWordSetCache(map[string]WordSetLoader{
+		"small":  loader("small", 10),
+		"small2": loader("small2", 10),
+		"large":  loader("large", 1000),
+	}, 2*smallCost)
+	ctx := context.Background()
+
+	for _, name := range []string{"small", "small2", "small", "large", "small"} {
+		if _, err := cache.Get(ctx, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Loading "large" evicted both small sets, and then loading "small"
+	// again evicted "large".
+	if loads["small"] != 2 || loads["small2"] != 1 || loads["large"] != 1 {
+		t.Error(loads)
+	}
+	stats := cache.Stats()
+	if stats.Entries != 1 || stats.Evictions != 3 || stats.Cost != smallCost {
+		t.Errorf("%+v", stats)
+	}
+
+	if _, err := cache.Get(ctx, "missing"); err == nil {
+		t.Error("Expected an error for an unknown name")
+	}
+}
+
+func TestMemoMapConcurrentGet(t *testing.T) {
+	var calls int32 = 0
+	release := make(chan struct{})
+	m := NewMemoMap(func(ctx context.Context, key int) (int, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return key * 2, nil
+	}, MemoMapLimits[int]{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(key int) {
+			defer wg.Done()
+			if r, err := m.Get(context.Background(), key); err != nil ||
+				r != key*2 {
+				t.Error(r, err)
+			}
+		}(i % 2)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if calls != 2 {
+		t.Error(calls)
+	}
+	if stats := m.Stats(); stats.Misses != 2 || stats.Hits != 18 {
+		t.Errorf("%+v", stats)
+	}
+}
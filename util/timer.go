@@ -0,0 +1,364 @@
+// A countdown timer for game rounds. It can be paused, resumed and extended
+// while it runs, and it reports its progress to subscribers as events, such
+// as warnings when the remaining time crosses configured thresholds.
+
+package util
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+type TimerEventKind int
+
+const (
+	// Run was called.
+	TimerStarted TimerEventKind = iota
+	// The remaining time reached one of the warning thresholds.
+	TimerWarning
+	// The remaining time reached a whole multiple of the tick interval.
+	TimerTick
+	TimerPaused
+	TimerResumed
+	TimerExtended
+	// The remaining time reached zero. No events follow.
+	TimerExpired
+	// Run's context was done before the timer expired. No events follow.
+	TimerCancelled
+)
+
+func (self TimerEventKind) String() string {
+	switch self {
+	case TimerStarted:
+		return "started"
+	case TimerWarning:
+		return "warning"
+	case TimerTick:
+		return "tick"
+	case TimerPaused:
+		return "paused"
+	case TimerResumed:
+		return "resumed"
+	case TimerExtended:
+		return "extended"
+	case TimerExpired:
+		return "expired"
+	case TimerCancelled:
+		return "cancelled"
+	}
+	return fmt.Sprintf("TimerEventKind(%d)", int(self))
+}
+
+type TimerEvent struct {
+	Kind TimerEventKind
+	// Time left when the event happened.
+	Remaining time.Duration
+	// For TimerWarning, the threshold which was reached. For TimerExtended,
+	// the extension.
+	Threshold time.Duration
+}
+
+type Timer struct {
+	clock Clock
+
+	// Interval between TimerTick events. Zero disables them.
+	tickInterval time.Duration
+
+	mutex sync.Mutex
+	// When the timer will expire, if it is running.
+	deadline time.Time
+	// Time left, if it is paused.
+	remaining time.Duration
+	paused    bool
+	finished  bool
+
+	// Warning thresholds in descending order. thresholds[:nextThreshold]
+	// have already been reached.
+	thresholds    []time.Duration
+	nextThreshold int
+	// The remaining time at which the next TimerTick is due, or zero if none
+	// is.
+	nextTick time.Duration
+
+	subscribers []func(event TimerEvent)
+	// Events waiting to be delivered by Run.
+	pending []TimerEvent
+	// Wakes up Run after the state changes.
+	wake chan struct{}
+}
+
+// Creates a timer for 'duration', which starts counting down when Run is
+// called. A TimerWarning event is sent as the remaining time reaches each of
+// 'thresholds' which is less than 'duration'. A TimerTick event is sent at
+// every whole 'tickInterval' of remaining time, unless 'tickInterval' is
+// zero.
+func NewTimer(clock Clock, duration time.Duration,
+	thresholds []time.Duration, tickInterval time.Duration) *Timer {
+	sorted := make([]time.Duration, len(thresholds))
+	copy(sorted, thresholds)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] > sorted[j]
+	})
+	t := &Timer{
+		clock:        clock,
+		tickInterval: tickInterval,
+		remaining:    duration,
+		paused:       true,
+		thresholds:   sorted,
+		wake:         make(chan struct{}, 1),
+	}
+	t.skipThresholds()
+	t.skipTicks(duration)
+	return t
+}
+
+// Registers 'f' to receive this timer's events. Events are delivered one at
+// a time, on the goroutine which called Run, so 'f' should return quickly.
+// It may call the timer's other methods.
+func (self *Timer) Subscribe(f func(event TimerEvent)) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.subscribers = append(self.subscribers, f)
+}
+
+// Runs the timer until it expires or 'ctx' is done, delivering events to
+// the subscribers. Returns nil if the timer expired, or ctx.Err().
+func (self *Timer) Run(ctx context.Context) error {
+	self.mutex.Lock()
+	if self.finished {
+		self.mutex.Unlock()
+		return fmt.Errorf("Timer has already finished")
+	}
+	self.deadline = self.clock.Now().Add(self.remaining)
+	self.paused = false
+	self.queue(TimerStarted, self.remaining, 0)
+	self.mutex.Unlock()
+
+	for {
+		wait, finished := self.Poll()
+		if finished {
+			return nil
+		}
+
+		var timeout <-chan time.Time = nil
+		if wait > 0 {
+			timeout = self.clock.After(wait)
+		}
+		select {
+		case <-ctx.Done():
+			self.mutex.Lock()
+			self.finished = true
+			self.queue(TimerCancelled, self.remainingAt(self.clock.Now()), 0)
+			self.mutex.Unlock()
+			self.deliver()
+			return ctx.Err()
+		case <-timeout:
+		case <-self.wake:
+		}
+	}
+}
+
+// Sends any events which are due at the clock's current time. Run calls
+// this, but callers which drive their own loop may call it instead. Returns
+// how long to wait before the next event is due (zero if none is, because
+// the timer is paused) and whether the timer has finished.
+func (self *Timer) Poll() (time.Duration, bool) {
+	self.mutex.Lock()
+	now := self.clock.Now()
+	wait := time.Duration(0)
+	if !self.finished {
+		remaining := self.remainingAt(now)
+		for self.nextThreshold < len(self.thresholds) &&
+			self.thresholds[self.nextThreshold] >= remaining {
+			self.queue(TimerWarning, remaining,
+				self.thresholds[self.nextThreshold])
+			self.nextThreshold++
+		}
+		if self.nextTick > 0 && self.nextTick >= remaining {
+			// Only send one tick, even if we slept through several.
+			self.queue(TimerTick, remaining, 0)
+			self.skipTicks(remaining)
+		}
+
+		if remaining <= 0 && !self.paused {
+			self.finished = true
+			self.queue(TimerExpired, 0, 0)
+		} else if !self.paused {
+			wait = remaining
+			if self.nextThreshold < len(self.thresholds) {
+				wait = remaining - self.thresholds[self.nextThreshold]
+			}
+			if self.nextTick > 0 && remaining-self.nextTick < wait {
+				wait = remaining - self.nextTick
+			}
+		}
+	}
+	finished := self.finished
+	self.mutex.Unlock()
+
+	self.deliver()
+	return wait, finished
+}
+
+// Stops the countdown until Resume is called.
+func (self *Timer) Pause() {
+	self.update(func(now time.Time) {
+		if !self.paused {
+			self.remaining = self.remainingAt(now)
+			self.paused = true
+			self.queue(TimerPaused, self.remaining, 0)
+		}
+	})
+}
+
+func (self *Timer) Resume() {
+	self.update(func(now time.Time) {
+		if self.paused {
+			self.deadline = now.Add(self.remaining)
+			self.paused = false
+			self.queue(TimerResumed, self.remaining, 0)
+		}
+	})
+}
+
+// Adds 'd' to the remaining time. Warning thresholds which are no longer
+// reached will be reported again.
+func (self *Timer) Extend(d time.Duration) {
+	self.update(func(now time.Time) {
+		if self.paused {
+			self.remaining += d
+		} else {
+			self.deadline = self.deadline.Add(d)
+		}
+		self.skipThresholds()
+		self.skipTicks(self.remainingAt(now))
+		self.queue(TimerExtended, self.remainingAt(now), d)
+	})
+}
+
+// Returns the time left, which is never negative.
+func (self *Timer) Remaining() time.Duration {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.remainingAt(self.clock.Now())
+}
+
+func (self *Timer) Paused() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.paused
+}
+
+// Prints a countdown on a single terminal line, like VerboseSleep does.
+type TimerDisplay struct {
+	Out io.Writer
+	// Printed before the remaining time.
+	Label string
+	// Printed on its own line when the timer expires.
+	Done string
+	// If true, ring the terminal bell when the timer expires.
+	Bell bool
+}
+
+// Handles a timer event. Pass this to Timer.Subscribe.
+func (self TimerDisplay) Handle(event TimerEvent) {
+	// Home the cursor and clear to end of line.
+	const clear = "\033[9999D\033[K"
+	switch event.Kind {
+	case TimerExpired, TimerCancelled:
+		fmt.Fprint(self.Out, clear)
+		if event.Kind == TimerExpired {
+			fmt.Fprintln(self.Out, self.Done)
+			if self.Bell {
+				fmt.Fprint(self.Out, "\007")
+			}
+		}
+	case TimerPaused:
+		fmt.Fprintf(self.Out, "%s%s%s (paused)", clear, self.Label,
+			roundUp(event.Remaining))
+	default:
+		fmt.Fprintf(self.Out, "%s%s%s", clear, self.Label,
+			roundUp(event.Remaining))
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// HELPERS
+
+// Must be called with the mutex held.
+func (self *Timer) remainingAt(now time.Time) time.Duration {
+	remaining := self.remaining
+	if !self.paused {
+		remaining = self.deadline.Sub(now)
+	}
+	if remaining < 0 {
+		remaining = 0
+	}
+	return remaining
+}
+
+// Marks the thresholds at or above the remaining time as reached, and the
+// rest as not reached. Must be called with the mutex held.
+func (self *Timer) skipThresholds() {
+	remaining := self.remainingAt(self.clock.Now())
+	self.nextThreshold = sort.Search(len(self.thresholds), func(i int) bool {
+		return self.thresholds[i] < remaining
+	})
+}
+
+// Schedules the next TimerTick for the highest multiple of the tick interval
+// below 'remaining'. Must be called with the mutex held.
+func (self *Timer) skipTicks(remaining time.Duration) {
+	self.nextTick = 0
+	if self.tickInterval > 0 && remaining > self.tickInterval {
+		self.nextTick = (remaining - 1) / self.tickInterval * self.tickInterval
+	}
+}
+
+// Applies 'f' to the timer's state and then wakes up Run.
+func (self *Timer) update(f func(now time.Time)) {
+	self.mutex.Lock()
+	if !self.finished {
+		f(self.clock.Now())
+	}
+	self.mutex.Unlock()
+
+	select {
+	case self.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Must be called with the mutex held.
+func (self *Timer) queue(kind TimerEventKind, remaining,
+	threshold time.Duration) {
+	self.pending = append(self.pending, TimerEvent{kind, remaining, threshold})
+}
+
+// Delivers the pending events. Must be called without the mutex held.
+func (self *Timer) deliver() {
+	for {
+		self.mutex.Lock()
+		if len(self.pending) == 0 {
+			self.mutex.Unlock()
+			return
+		}
+		event := self.pending[0]
+		self.pending = self.pending[1:]
+		subscribers := self.subscribers
+		self.mutex.Unlock()
+
+		for _, f := range subscribers {
+			f(event)
+		}
+	}
+}
+
+// Rounds 'd' up to a whole number of seconds.
+func roundUp(d time.Duration) time.Duration {
+	return (d + time.Second - 1) / time.Second * time.Second
+}
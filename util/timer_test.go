@@ -0,0 +1,189 @@
+package util_test
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+import . "github.com/sethpollen/dorkalonius/util"
+
+var epoch = time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Records the kinds and remaining times of a timer's events.
+type eventLog struct {
+	events []string
+}
+
+func (self *eventLog) record(event TimerEvent) {
+	self.events = append(self.events,
+		event.Kind.String()+" "+event.Remaining.String())
+}
+
+func (self *eventLog) take() []string {
+	events := self.events
+	self.events = nil
+	return events
+}
+
+func checkEvents(t *testing.T, log *eventLog, expected ...string) {
+	actual := log.take()
+	if len(actual) == 0 && len(expected) == 0 {
+		return
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected events %v; got %v", expected, actual)
+	}
+}
+
+// Starts 'timer' running on another goroutine and waits for it to block on
+// 'clock'.
+func startTimer(t *testing.T, ctx context.Context, timer *Timer,
+	clock *FakeClock) chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- timer.Run(ctx)
+	}()
+	awaitWaiters(t, clock, 1)
+	return done
+}
+
+func awaitWaiters(t *testing.T, clock *FakeClock, n int) {
+	for i := 0; clock.Waiters() < n; i++ {
+		if i > 1000 {
+			t.Fatalf("Timer never waited on the clock")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Advances 'clock' by 'd' and waits for the timer to block on it again.
+func advance(t *testing.T, clock *FakeClock, d time.Duration) {
+	clock.Advance(d)
+	awaitWaiters(t, clock, 1)
+}
+
+func TestTimerWarnings(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	timer := NewTimer(clock, 90*time.Second,
+		[]time.Duration{0, 10 * time.Second, 60 * time.Second}, 0)
+	log := &eventLog{}
+	timer.Subscribe(log.record)
+
+	done := startTimer(t, context.Background(), timer, clock)
+	checkEvents(t, log, "started 1m30s")
+
+	advance(t, clock, 30*time.Second)
+	checkEvents(t, log, "warning 1m0s")
+	if timer.Remaining() != 60*time.Second {
+		t.Errorf("Wrong remaining time: %v", timer.Remaining())
+	}
+
+	advance(t, clock, 50*time.Second)
+	checkEvents(t, log, "warning 10s")
+
+	clock.Advance(10 * time.Second)
+	if err := <-done; err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	checkEvents(t, log, "warning 0s", "expired 0s")
+}
+
+func TestTimerPauseAndExtend(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	timer := NewTimer(clock, 30*time.Second,
+		[]time.Duration{10 * time.Second}, 0)
+	log := &eventLog{}
+	timer.Subscribe(log.record)
+	if timer.Poll(); len(log.take()) != 0 {
+		t.Errorf("Timer sent events before it started")
+	}
+
+	done := startTimer(t, context.Background(), timer, clock)
+	checkEvents(t, log, "started 30s")
+
+	clock.Advance(5 * time.Second)
+	timer.Pause()
+	if !timer.Paused() {
+		t.Errorf("Expected timer to be paused")
+	}
+	// A paused timer doesn't wait on the clock.
+	for clock.Waiters() > 0 {
+		clock.Advance(time.Minute)
+		time.Sleep(time.Millisecond)
+	}
+	if timer.Remaining() != 25*time.Second {
+		t.Errorf("Wrong remaining time: %v", timer.Remaining())
+	}
+
+	timer.Resume()
+	awaitWaiters(t, clock, 1)
+	advance(t, clock, 20*time.Second)
+	checkEvents(t, log, "paused 25s", "resumed 25s", "warning 5s")
+
+	// Extending past the threshold re-arms it.
+	timer.Extend(20 * time.Second)
+	awaitWaiters(t, clock, 2)
+	advance(t, clock, 15*time.Second)
+	checkEvents(t, log, "extended 25s", "warning 10s")
+
+	clock.Advance(10 * time.Second)
+	if err := <-done; err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	checkEvents(t, log, "expired 0s")
+
+	if timer.Run(context.Background()) == nil {
+		t.Errorf("Expected error when running a finished timer")
+	}
+}
+
+func TestTimerCancel(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	timer := NewTimer(clock, time.Minute, nil, 0)
+	log := &eventLog{}
+	timer.Subscribe(log.record)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := startTimer(t, ctx, timer, clock)
+	clock.Advance(15 * time.Second)
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Expected context.Canceled; got %v", err)
+	}
+	checkEvents(t, log, "started 1m0s", "cancelled 45s")
+}
+
+func TestTimerTicks(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	timer := NewTimer(clock, 2500*time.Millisecond, nil, time.Second)
+	log := &eventLog{}
+	timer.Subscribe(log.record)
+
+	done := startTimer(t, context.Background(), timer, clock)
+	advance(t, clock, 500*time.Millisecond)
+	advance(t, clock, time.Second)
+	clock.Advance(time.Second)
+	<-done
+	checkEvents(t, log, "started 2.5s", "tick 2s", "tick 1s", "expired 0s")
+}
+
+func TestTimerDisplay(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	timer := NewTimer(clock, 1500*time.Millisecond, nil, time.Second)
+	var out bytes.Buffer
+	timer.Subscribe(TimerDisplay{
+		Out: &out, Label: "Left: ", Done: "Done", Bell: true}.Handle)
+
+	done := startTimer(t, context.Background(), timer, clock)
+	advance(t, clock, 500*time.Millisecond)
+	clock.Advance(time.Second)
+	<-done
+
+	const clear = "\033[9999D\033[K"
+	expected := clear + "Left: 2s" + clear + "Left: 1s" + clear + "Done\n\007"
+	if out.String() != expected {
+		t.Errorf("Expected %q; got %q", expected, out.String())
+	}
+}
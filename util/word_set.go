@@ -1,12 +1,15 @@
 // Defines a container for words which tracks word weights and allows random
 // sampling. Words are stored in a sorted AVL tree, with each internal
 // node storing the number and total weight of its descendant leaves.
+//
+// Each node records which WordSet owns it. A WordSet modifies its own nodes
+// in place, but copies any other node before modifying it. Snapshot and the
+// set operations use this to share structure between WordSets.
 
 package util
 
 import (
   "bytes"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -14,11 +17,34 @@ import (
 	"math/rand"
 	"sort"
 	"strings"
+	"sync/atomic"
+	"unsafe"
 )
 
 type WeightedWord struct {
 	Word      string
 	Weight    int64
+
+	// Optional extra information about the word.
+	Attributes WordAttributes
+}
+
+// Optional per-word information, such as that provided by frequency lists
+// like COCA. The zero value of each field means "unknown".
+type WordAttributes struct {
+	// Part of speech code (e.g. "j" for adjectives in COCA).
+	PartOfSpeech string
+
+	// Frequency rank in the source list, starting at 1, or 0 if unknown. Must
+	// not be negative.
+	Rank int64
+
+	// How evenly the word is spread across the source corpus, from 0 to 1.
+	Dispersion float64
+}
+
+func (self WordAttributes) IsZero() bool {
+	return self == WordAttributes{}
 }
 
 type node struct {
@@ -34,20 +60,71 @@ type node struct {
 	SubtreeHeight int
 	SubtreeSize   int64
 	SubtreeWeight int64
+	// Largest weight of any word in the subtree.
+	SubtreeMaxWeight int64
+
+	// The WordSet which may modify this node in place.
+	owner *ownerToken
+}
+
+func newLeafNode(word WeightedWord, owner *ownerToken) *node {
+	return &node{nil, nil, word, 1, 1, word.Weight, word.Weight, owner}
 }
 
-func newLeafNode(word WeightedWord) *node {
-	// Newly inserted nodes start out as red.
-	return &node{nil, nil, word, 1, 1, word.Weight}
+// Identifies a WordSet for the purposes of node ownership. Nodes with a nil
+// owner are never modified in place.
+type ownerToken struct {
+	// Nonzero once the owner's nodes have been shared with another WordSet.
+	// The owner must then switch to a new token before its next update.
+	frozen int32
+}
+
+// Marks the nodes owned by 'self' as shared. Safe to call concurrently with
+// reads of the owning WordSet.
+func (self *ownerToken) freeze() {
+	if self != nil {
+		atomic.StoreInt32(&self.frozen, 1)
+	}
 }
 
 type WordSet struct {
 	// nil for an empty WordSet.
 	root *node
+
+	// Nodes with this owner may be modified in place.
+	owner *ownerToken
+
+	// If true, words are keyed by (Word, Attributes.PartOfSpeech) rather than
+	// by Word alone, so homographs with different parts of speech are kept
+	// apart. Entries with the same Word are adjacent in the tree, so queries
+	// by Word alone still work.
+	composite bool
+}
+
+// The queries shared by WordSet and FlatWordSet, for code which only reads.
+type ReadOnlyWordSet interface {
+	IsComposite() bool
+	Size() int64
+	Weight() int64
+	Lookup(word string) (WeightedWord, bool)
+	LookupPos(word string, pos string) (WeightedWord, bool)
+	Rank(word string) int64
+	CumulativeWeight(word string) int64
+	Select(i int64) (WeightedWord, bool)
+	Range(lo, hi string) []WeightedWord
+	Prefix(prefix string) []WeightedWord
+	GetWords() []WeightedWord
+	Each(f func(word WeightedWord) bool)
+	SampleDistinct(r *rand.Rand, n int64, nodeBias int64) (WordSet, error)
 }
 
 func NewWordSet() WordSet {
-	return WordSet{nil}
+	return WordSet{nil, nil, false}
+}
+
+// Returns an empty WordSet which uses composite (Word, PartOfSpeech) keys.
+func NewCompositeWordSet() WordSet {
+	return WordSet{nil, nil, true}
 }
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -60,20 +137,33 @@ func (self WordSet) Check() error {
 	}
 
 	// Check overall sortedness.
-	var last string = ""
+	var last *node = nil
 	var err error = nil
 	visit(self.root, 0, func(n *node, depth int) {
 		if err != nil {
 			return
 		}
-		if last != "" && strings.Compare(last, n.Word.Word) >= 0 {
+		if last != nil && self.compare(last.Word, n.Word) >= 0 {
 			err = errors.New("Not ordered")
 		}
-		last = n.Word.Word
+		last = n
 	})
 	return err
 }
 
+// Returns true iff this set uses composite (Word, PartOfSpeech) keys.
+func (self WordSet) IsComposite() bool {
+	return self.composite
+}
+
+// Returns a new, non-composite WordSet in which all entries sharing a Word
+// are merged. Merged entries have their weights added and take the
+// attributes of the heaviest entry. For a non-composite set, this just
+// returns a copy, which shares nodes with this set as a Snapshot would.
+func (self WordSet) Aggregate() WordSet {
+	return self.withMode(false)
+}
+
 func (self WordSet) Size() int64 {
 	return subtreeSize(self.root)
 }
@@ -82,6 +172,9 @@ func (self WordSet) Weight() int64 {
 	return subtreeWeight(self.root)
 }
 
+// Adds 'word' to this set. If the word is already present, its weight is
+// increased by word.Weight and its attributes are left alone (unless they
+// were unknown).
 func (self *WordSet) Add(word WeightedWord) {
 	self.add(word, false)
 }
@@ -98,6 +191,156 @@ func (self *WordSet) AddAll(other WordSet) {
 	})
 }
 
+// Returns an immutable view of the current contents of this set. The view
+// shares structure with this set; later updates to this set copy the O(log n)
+// nodes they touch rather than modifying shared ones. The view may therefore
+// be read from any number of goroutines while a single goroutine continues
+// to update this set.
+//
+// The returned WordSet may itself be updated, with the same copy-on-write
+// behavior, but it must not be updated concurrently with reads of it.
+func (self *WordSet) Snapshot() WordSet {
+	// Neither this set nor the snapshot owns any of the existing nodes.
+	self.owner = &ownerToken{}
+	return WordSet{self.root, &ownerToken{}, self.composite}
+}
+
+// Removes 'word' from this set, regardless of its weight. In a composite set,
+// this removes the word under every part of speech. Returns true iff the
+// word was present.
+func (self *WordSet) Remove(word string) bool {
+	removed := false
+	for {
+		path := self.find(WeightedWord{Word: word}, true)
+		if path == nil {
+			return removed
+		}
+		self.remove(path)
+		removed = true
+	}
+}
+
+// Subtracts word.Weight from the weight of 'word' in this set. If the weight
+// drops to zero or below, the word is removed entirely. Returns true iff the
+// word was present.
+func (self *WordSet) Subtract(word WeightedWord) bool {
+	if word.Weight <= 0 {
+		log.Fatal("Weights must be positive")
+	}
+
+	path := self.find(word, false)
+	if path == nil {
+		return false
+	}
+	self.beginUpdate()
+	self.mutablePath(path)
+
+	n := path[len(path)-1]
+	if n.Word.Weight <= word.Weight {
+		self.remove(path)
+		return true
+	}
+	n.Word.Weight -= word.Weight
+	// Nothing moved, but the ancestors' subtree weights must be updated.
+	self.rebalance(path)
+	return true
+}
+
+// Removes every word in 'other' from this set. The weights in 'other' are
+// ignored. If both sets are composite, only matching parts of speech are
+// removed; otherwise words are removed under every part of speech.
+func (self *WordSet) RemoveAll(other WordSet) {
+	visit(other.root, 0, func(n *node, depth int) {
+		if self.composite && other.composite {
+			if path := self.find(n.Word, false); path != nil {
+				self.remove(path)
+			}
+		} else {
+			self.Remove(n.Word.Word)
+		}
+	})
+}
+
+// Looks up 'word' in this set. The second return value is false if the word
+// is not present. In a composite set, this aggregates across parts of
+// speech: the result's weight is the total for all entries with this Word,
+// and its attributes are those of the heaviest entry.
+func (self WordSet) Lookup(word string) (WeightedWord, bool) {
+	entries := self.Range(word, word+"\x00")
+	if len(entries) == 0 {
+		return WeightedWord{}, false
+	}
+	return mergeEntries(entries), true
+}
+
+// Looks up the entry for 'word' with the given part of speech. In a
+// non-composite set, this succeeds only if the word's recorded part of
+// speech is 'pos'.
+func (self WordSet) LookupPos(word string, pos string) (WeightedWord, bool) {
+	for _, entry := range self.Range(word, word+"\x00") {
+		if entry.Attributes.PartOfSpeech == pos {
+			return entry, true
+		}
+	}
+	return WeightedWord{}, false
+}
+
+// Returns the number of words in this set which sort strictly before 'word'.
+// 'word' itself need not be present.
+func (self WordSet) Rank(word string) int64 {
+	size, _ := self.countBefore(word)
+	return size
+}
+
+// Returns the total weight of the words in this set which sort strictly
+// before 'word'. 'word' itself need not be present.
+func (self WordSet) CumulativeWeight(word string) int64 {
+	_, weight := self.countBefore(word)
+	return weight
+}
+
+// Returns the word at position 'i' in alphabetical order, counting from 0.
+// The second return value is false if 'i' is out of range.
+func (self WordSet) Select(i int64) (WeightedWord, bool) {
+	if i < 0 || i >= self.Size() {
+		return WeightedWord{}, false
+	}
+	cur := self.root
+	for {
+		leftSize := subtreeSize(cur.Left)
+		if i < leftSize {
+			cur = cur.Left
+			continue
+		}
+		i -= leftSize
+		if i == 0 {
+			return cur.Word, true
+		}
+		i--
+		cur = cur.Right
+	}
+}
+
+// Gets the words 'w' in this set with lo <= w < hi, in alphabetical order.
+func (self WordSet) Range(lo, hi string) []WeightedWord {
+	words := make([]WeightedWord, 0)
+	visitRange(self.root, lo, hi, true, func(n *node) {
+		words = append(words, n.Word)
+	})
+	return words
+}
+
+// Gets the words in this set which start with 'prefix', in alphabetical
+// order.
+func (self WordSet) Prefix(prefix string) []WeightedWord {
+	hi, hasHi := prefixEnd(prefix)
+	words := make([]WeightedWord, 0)
+	visitRange(self.root, prefix, hi, hasHi, func(n *node) {
+		words = append(words, n.Word)
+	})
+	return words
+}
+
 // Gets the contents of this WordSet, sorted by descending weight.
 func (self WordSet) GetWords() []WeightedWord {
 	words := make([]WeightedWord, self.Size())
@@ -111,29 +354,68 @@ func (self WordSet) GetWords() []WeightedWord {
 }
 
 // Randomly samples 'n' words from this WordSet (using their Weights) and returns
-// those words. 'nodeBias' will be added to every node's weight.
-func (self WordSet) Sample(n int64, nodeBias int64) WordSet {
+// those words. 'nodeBias' will be added to every node's weight. All
+// randomness is drawn from 'r', so the same seed always yields the same
+// sample.
+//
+// This calls log.Fatal if the sample cannot be drawn; code which must not
+// exit should use SampleDistinct instead.
+func (self WordSet) Sample(r *rand.Rand, n int64, nodeBias int64) WordSet {
+	sample, err := self.SampleDistinct(r, n, nodeBias)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return sample
+}
+
+// Like Sample, but returns an error instead of exiting. Words which have
+// already been drawn have their weight excluded from the subtree sums for
+// the remaining draws, so every draw yields a new word and the running time
+// is O(n log Size()) no matter how the weight is distributed.
+func (self WordSet) SampleDistinct(r *rand.Rand, n int64,
+	nodeBias int64) (WordSet, error) {
+	if n < 0 {
+		return NewWordSet(), fmt.Errorf("Cannot sample %d words", n)
+	}
 	if n > self.Size() {
-		log.Fatalf("Cannot sample %d words from a WordSet of size %d",
-			n, self.Size())
+		return NewWordSet(), fmt.Errorf(
+			"Cannot sample %d words from a WordSet of size %d", n, self.Size())
+	}
+	if nodeBias < 0 {
+		return NewWordSet(), fmt.Errorf("Negative nodeBias: %d", nodeBias)
 	}
-	totalWeight := self.Weight() + nodeBias*self.Size()
 
-	sample := NewWordSet()
+	// Total weight of the already-drawn words in each subtree, keyed by the
+	// subtree's root.
+	drawn := make(map[*node]int64)
+	remainingWeight := func(n *node) int64 {
+		return subtreeWeight(n) + nodeBias*subtreeSize(n) - drawn[n]
+	}
+
+	sample := self.empty()
+	path := make([]*node, 0, subtreeHeight(self.root))
 	for sample.Size() < n {
-		point := rand.Int63n(totalWeight)
+		point := r.Int63n(remainingWeight(self.root))
+		path = path[:0]
 		cur := self.root
 		for {
-			leftWeight := subtreeWeight(cur.Left) + nodeBias*subtreeSize(cur.Left)
+			path = append(path, cur)
+
+			leftWeight := remainingWeight(cur.Left)
 			if point < leftWeight {
 				cur = cur.Left
 				continue
 			}
 			point -= leftWeight
 
-			curWeight := cur.Word.Weight + nodeBias
+			// This is zero if 'cur' has already been drawn.
+			curWeight := remainingWeight(cur) - leftWeight -
+				remainingWeight(cur.Right)
 			if point < curWeight {
 				sample.Insert(cur.Word)
+				for _, p := range path {
+					drawn[p] += curWeight
+				}
 				break
 			}
 			point -= curWeight
@@ -141,7 +423,18 @@ func (self WordSet) Sample(n int64, nodeBias int64) WordSet {
 			cur = cur.Right
 		}
 	}
-	return sample
+	return sample, nil
+}
+
+// Estimates the heap memory used by this set, in bytes. Nodes shared with
+// snapshots are counted in full.
+func (self WordSet) MemoryUsage() int64 {
+	var total int64 = 0
+	visit(self.root, 0, func(n *node, depth int) {
+		total += int64(unsafe.Sizeof(*n)) + int64(len(n.Word.Word)) +
+			int64(len(n.Word.Attributes.PartOfSpeech))
+	})
+	return total
 }
 
 func (self WordSet) PrettyPrint() string {
@@ -151,18 +444,19 @@ func (self WordSet) PrettyPrint() string {
 ///////////////////////////////////////////////////////////////////////////////
 // SERIALIZATION
 
-var byteOrder = binary.LittleEndian
-
+// Writes this WordSet in the current (v2) binary format. See
+// word_set_format.go for a description of the format.
 func (self WordSet) Serialize(out io.Writer) error {
-	return serialize(out, self.root)
+	return serializeV2(out, self)
 }
 
+// Reads a WordSet written by Serialize. Both the current (v2) format and the
+// legacy unversioned (v1) format are accepted.
 func DeserializeWordSet(in io.Reader) (*WordSet, error) {
-	root, err := deserialize(in)
+	words, err := deserialize(in)
 	if err != nil {
-		return nil, fmt.Errorf("%v. Read so far:\n%s", err, prettyPrint(root))
+		return nil, err
 	}
-	words := &WordSet{root}
 	if err = words.Check(); err != nil {
 		return nil, err
 	}
@@ -178,22 +472,28 @@ func (self *WordSet) add(word WeightedWord, requireInsert bool) bool {
 	if word.Weight <= 0 {
 		log.Fatal("Weights must be positive")
 	}
+	self.beginUpdate()
 
 	if self.root == nil {
-		self.root = newLeafNode(word)
+		self.root = newLeafNode(word, self.owner)
 		return true
 	}
 
+	self.root = self.mutable(self.root)
 	path := []*node{self.root}
 	for {
 		cur := path[len(path)-1]
 
-		c := strings.Compare(word.Word, cur.Word.Word)
+		c := self.compare(word, cur.Word)
 		if c == 0 {
 			if requireInsert {
 				return false
 			}
 			cur.Word.Weight += word.Weight
+			// The first known attributes for a word win.
+			if cur.Word.Attributes.IsZero() {
+				cur.Word.Attributes = word.Attributes
+			}
 			// We didn't actually insert any nodes, but we break to the rebalance
 			// call anyway in order to update subtree counts.
 			break
@@ -201,20 +501,22 @@ func (self *WordSet) add(word WeightedWord, requireInsert bool) bool {
 
 		if c < 0 {
 			if cur.Left == nil {
-				cur.Left = newLeafNode(word)
+				cur.Left = newLeafNode(word, self.owner)
 				path = append(path, cur.Left)
 				break
 			}
+			cur.Left = self.mutable(cur.Left)
 			path = append(path, cur.Left)
 			continue
 		}
 
 		// c > 0
 		if cur.Right == nil {
-			cur.Right = newLeafNode(word)
+			cur.Right = newLeafNode(word, self.owner)
 			path = append(path, cur.Right)
 			break
 		}
+		cur.Right = self.mutable(cur.Right)
 		path = append(path, cur.Right)
 	}
 
@@ -222,6 +524,111 @@ func (self *WordSet) add(word WeightedWord, requireInsert bool) bool {
 	return true
 }
 
+// Returns the path from the root to a node holding 'word', or nil if 'word'
+// is not in this set. If 'wordOnly' is true, only word.Word is compared, so
+// in a composite set this finds an entry with any part of speech.
+func (self *WordSet) find(word WeightedWord, wordOnly bool) []*node {
+	path := make([]*node, 0)
+	cur := self.root
+	for cur != nil {
+		path = append(path, cur)
+		c := compareWords(word, cur.Word, self.composite && !wordOnly)
+		if c == 0 {
+			return path
+		}
+		if c < 0 {
+			cur = cur.Left
+		} else {
+			cur = cur.Right
+		}
+	}
+	return nil
+}
+
+// Makes sure this set has an owner token which it may modify nodes under.
+// Must be called before each update.
+func (self *WordSet) beginUpdate() {
+	if self.owner == nil || atomic.LoadInt32(&self.owner.frozen) != 0 {
+		self.owner = &ownerToken{}
+	}
+}
+
+// Marks this set's nodes as shared, so that later updates to this set copy
+// them rather than modifying them in place.
+func (self WordSet) share() {
+	self.owner.freeze()
+}
+
+// Returns 'n' if this set owns it, or else an owned copy of 'n'. The caller
+// must replace any pointers to 'n' with the result.
+func (self *WordSet) mutable(n *node) *node {
+	if n.owner == self.owner {
+		return n
+	}
+	c := *n
+	c.owner = self.owner
+	return &c
+}
+
+// Replaces every node in 'path' (a path from the root) with a mutable node,
+// relinking the tree as needed.
+func (self *WordSet) mutablePath(path []*node) {
+	for i, n := range path {
+		m := self.mutable(n)
+		if i == 0 {
+			self.root = m
+		} else if path[i-1].Left == n {
+			path[i-1].Left = m
+		} else {
+			path[i-1].Right = m
+		}
+		path[i] = m
+	}
+}
+
+// Removes the last node in 'path' from the tree and rebalances.
+func (self *WordSet) remove(path []*node) {
+	target := len(path) - 1
+	n := path[target]
+
+	if n.Left != nil && n.Right != nil {
+		// Extend the path to n's in-order successor. We will replace n's
+		// contents with those of the successor and remove the successor node
+		// instead. The successor has no left child.
+		succ := n.Right
+		path = append(path, succ)
+		for succ.Left != nil {
+			succ = succ.Left
+			path = append(path, succ)
+		}
+	}
+
+	self.beginUpdate()
+	self.mutablePath(path)
+	n = path[len(path)-1]
+	path[target].Word = n.Word
+
+	// n now has at most one child, which takes n's place.
+	child := n.Left
+	if child == nil {
+		child = n.Right
+	}
+
+	path = path[:len(path)-1]
+	if len(path) == 0 {
+		self.root = child
+		return
+	}
+	parent := path[len(path)-1]
+	if parent.Left == n {
+		parent.Left = child
+	} else {
+		parent.Right = child
+	}
+
+	self.rebalance(path)
+}
+
 // Checks tree invariants. Returns an error on failure.
 func (self *WordSet) check(n *node) error {
 	if n == nil {
@@ -233,12 +640,12 @@ func (self *WordSet) check(n *node) error {
 	}
 
 	if n.Left != nil {
-		if strings.Compare(n.Left.Word.Word, n.Word.Word) >= 0 {
+		if self.compare(n.Left.Word, n.Word) >= 0 {
 			return errors.New("Not ordered")
 		}
 	}
 	if n.Right != nil {
-		if strings.Compare(n.Word.Word, n.Right.Word.Word) >= 0 {
+		if self.compare(n.Word, n.Right.Word) >= 0 {
 			return errors.New("Not ordered")
 		}
 	}
@@ -264,6 +671,13 @@ func (self *WordSet) check(n *node) error {
 			n.Word.Word, expectedSubtreeWeight, n.SubtreeWeight)
 	}
 
+	expectedSubtreeMaxWeight := max64(n.Word.Weight,
+		max64(subtreeMaxWeight(n.Left), subtreeMaxWeight(n.Right)))
+	if n.SubtreeMaxWeight != expectedSubtreeMaxWeight {
+		return fmt.Errorf("Bad SubtreeMaxWeight for %q: Expected %d, got %d",
+			n.Word.Word, expectedSubtreeMaxWeight, n.SubtreeMaxWeight)
+	}
+
 	imb := imbalance(n)
 	if abs(imb) > 1 {
 		return fmt.Errorf("Too much imbalance (%d) for %q\n%s",
@@ -284,8 +698,11 @@ func updateSubtreeInfo(n *node) {
 	n.SubtreeSize = subtreeSize(n.Left) + subtreeSize(n.Right) + 1
 	n.SubtreeWeight = subtreeWeight(n.Left) + subtreeWeight(n.Right) +
 		n.Word.Weight
+	n.SubtreeMaxWeight = max64(n.Word.Weight,
+		max64(subtreeMaxWeight(n.Left), subtreeMaxWeight(n.Right)))
 }
 
+// Rebalances the tree along 'path', a path of mutable nodes from the root.
 func (self *WordSet) rebalance(path []*node) {
 	for i := len(path) - 1; i >= 0; i-- {
 		n := path[i]
@@ -321,15 +738,15 @@ func (self *WordSet) rebalance(path []*node) {
     
     if imb < 0 {
       // n.Left is too tall.
-      if imbalance(n.Left) < 0 {
+      if imbalance(n.Left) <= 0 {
         // We must do an single right rotation.
         //     n             p
         //    / \           / \
         //   p   C   ==>   A   n
         //  / \               / \
         // A   B             B   C
-        // (Where A is taller than B).
-        p := n.Left
+        // (Where A is at least as tall as B).
+        p := self.mutable(n.Left)
         
         *nPtr = p
         n.Left = p.Right
@@ -345,8 +762,8 @@ func (self *WordSet) rebalance(path []*node) {
         // A   t            p   C         A   B C   D
         //    / \          / \
         //   B   C        A   B
-        p := n.Left
-        t := p.Right
+        p := self.mutable(n.Left)
+        t := self.mutable(p.Right)
 
         n.Left = t
         p.Right = t.Left
@@ -369,8 +786,8 @@ func (self *WordSet) rebalance(path []*node) {
         //     t   D          B   p        A   B C   D
         //    / \                / \
         //   B   C              C   D
-        p := n.Right
-        t := p.Left
+        p := self.mutable(n.Right)
+        t := self.mutable(p.Left)
 
         n.Right = t
         p.Left = t.Right
@@ -388,8 +805,8 @@ func (self *WordSet) rebalance(path []*node) {
         //   A   p    ==>    n   C
         //      / \         / \
         //     B   C       A   B
-        // (Where C is taller than B).
-        p := n.Right
+        // (Where C is at least as tall as B).
+        p := self.mutable(n.Right)
         
         *nPtr = p
         n.Right = p.Left
@@ -406,6 +823,122 @@ func (self *WordSet) rebalance(path []*node) {
 	}
 }
 
+// Returns an empty WordSet with the same key mode as this one.
+func (self WordSet) empty() WordSet {
+	return WordSet{nil, nil, self.composite}
+}
+
+// Returns this set's contents in a WordSet with the given key mode. The
+// result may share nodes with this set, as a Snapshot would.
+func (self WordSet) withMode(composite bool) WordSet {
+	if !self.composite || composite {
+		// Distinct words are also distinct composite keys, in the same order.
+		self.share()
+		return WordSet{self.root, nil, composite}
+	}
+
+	// Merge runs of entries which share a Word; these are adjacent.
+	merged := make([]WeightedWord, 0, self.Size())
+	var run []WeightedWord
+	visit(self.root, 0, func(n *node, depth int) {
+		if len(run) > 0 && run[0].Word != n.Word.Word {
+			merged = append(merged, mergeEntries(run))
+			run = run[:0]
+		}
+		run = append(run, n.Word)
+	})
+	if len(run) > 0 {
+		merged = append(merged, mergeEntries(run))
+	}
+	return WordSet{buildBalanced(merged, nil), nil, false}
+}
+
+// Compares words by this set's key.
+func (self WordSet) compare(a, b WeightedWord) int {
+	return compareWords(a, b, self.composite)
+}
+
+// Compares words by Word and then, if 'composite' is true, by part of speech.
+func compareWords(a, b WeightedWord, composite bool) int {
+	c := strings.Compare(a.Word, b.Word)
+	if c != 0 || !composite {
+		return c
+	}
+	return strings.Compare(a.Attributes.PartOfSpeech,
+		b.Attributes.PartOfSpeech)
+}
+
+// Merges entries which share a Word: weights are added, and attributes are
+// taken from the heaviest entry (the first, in case of ties).
+func mergeEntries(entries []WeightedWord) WeightedWord {
+	merged := entries[0]
+	heaviest := entries[0]
+	for _, entry := range entries[1:] {
+		merged.Weight += entry.Weight
+		if entry.Weight > heaviest.Weight {
+			heaviest = entry
+		}
+	}
+	merged.Attributes = heaviest.Attributes
+	return merged
+}
+
+// Returns the number and total weight of the words which sort strictly
+// before 'word'.
+func (self WordSet) countBefore(word string) (int64, int64) {
+	var size int64 = 0
+	var weight int64 = 0
+	cur := self.root
+	for cur != nil {
+		// In a composite set, entries equal to 'word' may appear on both sides
+		// of 'cur', so we keep descending rather than stopping here.
+		if strings.Compare(word, cur.Word.Word) <= 0 {
+			cur = cur.Left
+			continue
+		}
+		size += subtreeSize(cur.Left) + 1
+		weight += subtreeWeight(cur.Left) + cur.Word.Weight
+		cur = cur.Right
+	}
+	return size, weight
+}
+
+// Visits, in order, the nodes whose words 'w' satisfy lo <= w < hi. If
+// 'hasHi' is false, there is no upper bound. Subtrees which lie entirely
+// outside the range are skipped.
+func visitRange(n *node, lo, hi string, hasHi bool, visitor func(n *node)) {
+	if n == nil {
+		return
+	}
+	aboveLo := strings.Compare(lo, n.Word.Word) <= 0
+	belowHi := !hasHi || strings.Compare(n.Word.Word, hi) < 0
+	if aboveLo {
+		visitRange(n.Left, lo, hi, hasHi, visitor)
+	}
+	if aboveLo && belowHi {
+		visitor(n)
+	}
+	if belowHi {
+		visitRange(n.Right, lo, hi, hasHi, visitor)
+	}
+}
+
+// Returns the smallest string which sorts after every string starting with
+// 'prefix'. The second return value is false if there is no such string
+// (i.e. 'prefix' is empty or consists solely of 0xff bytes).
+func prefixEnd(prefix string) (string, bool) {
+	end := []byte(prefix)
+	for len(end) > 0 {
+		last := len(end) - 1
+		if end[last] < 0xff {
+			end[last]++
+			return string(end), true
+		}
+		end = end[:last]
+	}
+	return "", false
+}
+
 func visit(n *node, depth int, visitor func(n *node, depth int)) {
 	if n == nil {
 		return
@@ -442,6 +975,13 @@ func subtreeWeight(n *node) int64 {
 	return n.SubtreeWeight
 }
 
+func subtreeMaxWeight(n *node) int64 {
+	if n == nil {
+		return 0
+	}
+	return n.SubtreeMaxWeight
+}
+
 func children(n *node) int {
 	c := 0
 	if n.Left != nil {
@@ -460,6 +1000,13 @@ func max(a, b int) int {
 	return b
 }
 
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
 func abs(x int) int {
 	if x < 0 {
 		return -x
@@ -519,7 +1066,7 @@ func (self SortWeightedWords) Less(i, j int) bool {
 	if self[i].Weight != self[j].Weight {
 		return self[i].Weight > self[j].Weight
 	}
-	return strings.Compare(self[i].Word, self[j].Word) < 0
+	return compareWords(self[i], self[j], true) < 0
 }
 
 func (self SortWeightedWords) Swap(i, j int) {
@@ -527,74 +1074,3 @@ func (self SortWeightedWords) Swap(i, j int) {
 	self[i] = self[j]
 	self[j] = temp
 }
-
-// Serialization helpers.
-
-func serialize(out io.Writer, n *node) error {
-	if n == nil {
-		return binary.Write(out, byteOrder, int8(0))
-	}
-
-	if err := binary.Write(out, byteOrder, int8(1)); err != nil {
-		return err
-	}
-
-  if err := binary.Write(out, byteOrder, n.Word.Weight); err != nil {
-    return err
-  }
-	if err := binary.Write(out, byteOrder, int64(len(n.Word.Word))); err != nil {
-		return err
-	}
-	if _, err := out.Write([]byte(n.Word.Word)); err != nil {
-		return err
-	}
-
-	if err := serialize(out, n.Left); err != nil {
-		return err
-	}
-	if err := serialize(out, n.Right); err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func deserialize(in io.Reader) (*node, error) {
-	var tag int8
-	if err := binary.Read(in, byteOrder, &tag); err != nil {
-		return nil, err
-	}
-	if tag == 0 {
-		return nil, nil
-	}
-	if tag != 1 {
-		return nil, fmt.Errorf("Bad tag: %d", tag)
-	}
-
-	var weight int64
-	if err := binary.Read(in, byteOrder, &weight); err != nil {
-		return nil, err
-	}
-	
-	var wordLen int64
-	if err := binary.Read(in, byteOrder, &wordLen); err != nil {
-		return nil, err
-	}
-
-	var word = make([]byte, wordLen)
-	if _, err := in.Read(word); err != nil {
-		return nil, err
-	}
-
-	// Even if one of the children fails to parse, we still return this node.
-	n := &node{nil, nil, WeightedWord{string(word), weight}, 0, 0, 0}
-
-	var err error = nil
-	n.Left, err = deserialize(in)
-	if err == nil {
-	  n.Right, err = deserialize(in)
-	}
-  
-	updateSubtreeInfo(n)
-	return n, err
-}
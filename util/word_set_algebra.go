@@ -0,0 +1,297 @@
+// Set operations on WordSets. These use the join-based AVL algorithms, which
+// combine two trees of sizes m and n (m <= n) in O(m log(n/m + 1)) time
+// rather than re-inserting every word one at a time.
+//
+// All of these operations leave their inputs untouched. Their results share
+// any subtrees they didn't need to change with their inputs, as a Snapshot
+// would, so later updates to either side copy the shared nodes they touch.
+// Results use the key mode of 'self'; if 'other' uses a different mode, it
+// is converted first (see WordSet.Aggregate).
+
+package util
+
+// Returns a new WordSet containing every word from either 'self' or 'other'.
+// Words present in both have their weights merged using 'combine', which is
+// passed the weight from 'self' followed by the weight from 'other'; if
+// 'combine' is nil, the weights are added. Words for which 'combine' returns
+// a nonpositive weight are omitted. Attributes are taken from 'self' unless
+// they are unknown there.
+func (self WordSet) Union(other WordSet,
+	combine func(a, b int64) int64) WordSet {
+	if combine == nil {
+		combine = func(a, b int64) int64 { return a + b }
+	}
+	op := newTreeOp(self)
+	return op.result(op.union(self.root, other.withMode(self.composite).root,
+		combine))
+}
+
+// Returns a new WordSet containing the words of 'self' which are also in
+// 'other'. Weights are taken from 'self'.
+func (self WordSet) Intersect(other WordSet) WordSet {
+	op := newTreeOp(self)
+	return op.result(op.intersect(self.root,
+		other.withMode(self.composite).root))
+}
+
+// Returns a new WordSet containing the words of 'self' which are not in
+// 'other'.
+func (self WordSet) Difference(other WordSet) WordSet {
+	op := newTreeOp(self)
+	return op.result(op.difference(self.root,
+		other.withMode(self.composite).root))
+}
+
+// Returns a new WordSet containing the words of 'self' for which 'keep'
+// returns true. For example, this can select a single part of speech.
+func (self WordSet) Filter(keep func(word WeightedWord) bool) WordSet {
+	op := newTreeOp(self)
+	return op.result(op.filter(self.root, func(n *node) bool {
+		return keep(n.Word)
+	}, false))
+}
+
+// Returns a new WordSet with every weight multiplied by 'factor' and rounded
+// to the nearest integer. Words whose weight rounds to zero are omitted.
+func (self WordSet) Scale(factor float64) WordSet {
+	op := newTreeOp(self)
+	return op.result(op.filter(self.root, func(n *node) bool {
+		n.Word.Weight = int64(float64(n.Word.Weight)*factor + 0.5)
+		return n.Word.Weight > 0
+	}, true))
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// HELPERS
+
+// The state of one set operation. Nodes owned by 'owner' were created by the
+// operation and may be relinked freely; every other node belongs to an input
+// and is copied before being modified.
+type treeOp struct {
+	owner     *ownerToken
+	composite bool
+}
+
+// Starts an operation whose result uses the key mode of 'self'.
+func newTreeOp(self WordSet) *treeOp {
+	// The result will share nodes with 'self'.
+	self.share()
+	return &treeOp{&ownerToken{}, self.composite}
+}
+
+func (self *treeOp) result(root *node) WordSet {
+	return WordSet{root, self.owner, self.composite}
+}
+
+// Returns 'n' if this operation created it, or else a copy of 'n' which
+// this operation owns.
+func (self *treeOp) mutable(n *node) *node {
+	if n.owner == self.owner {
+		return n
+	}
+	c := *n
+	c.owner = self.owner
+	return &c
+}
+
+func (self *treeOp) union(a, b *node, combine func(a, b int64) int64) *node {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	l, m, r := self.split(b, a.Word)
+	left := self.union(a.Left, l, combine)
+	right := self.union(a.Right, r, combine)
+	if m != nil {
+		a = self.mutable(a)
+		a.Word.Weight = combine(a.Word.Weight, m.Word.Weight)
+		if a.Word.Attributes.IsZero() {
+			a.Word.Attributes = m.Word.Attributes
+		}
+		if a.Word.Weight <= 0 {
+			return self.join2(left, right)
+		}
+	}
+	return self.join(left, a, right)
+}
+
+func (self *treeOp) intersect(a, b *node) *node {
+	if a == nil || b == nil {
+		return nil
+	}
+	l, m, r := self.split(b, a.Word)
+	left := self.intersect(a.Left, l)
+	right := self.intersect(a.Right, r)
+	if m == nil {
+		return self.join2(left, right)
+	}
+	return self.join(left, a, right)
+}
+
+func (self *treeOp) difference(a, b *node) *node {
+	if a == nil || b == nil {
+		return a
+	}
+	l, _, r := self.split(a, b.Word)
+	return self.join2(self.difference(l, b.Left),
+		self.difference(r, b.Right))
+}
+
+// Keeps only the nodes for which 'keep' returns true. If 'modifies' is true,
+// 'keep' may modify the node's weight, but not its word.
+func (self *treeOp) filter(n *node, keep func(n *node) bool,
+	modifies bool) *node {
+	if n == nil {
+		return nil
+	}
+	left := self.filter(n.Left, keep, modifies)
+	right := self.filter(n.Right, keep, modifies)
+	if modifies {
+		n = self.mutable(n)
+	}
+	if !keep(n) {
+		return self.join2(left, right)
+	}
+	return self.join(left, n, right)
+}
+
+// Splits the tree 'n' into the nodes sorting before 'word', the node holding
+// 'word' (or nil), and the nodes sorting after 'word'. The middle node is
+// returned with no children.
+func (self *treeOp) split(n *node, word WeightedWord) (*node, *node, *node) {
+	if n == nil {
+		return nil, nil, nil
+	}
+	c := compareWords(word, n.Word, self.composite)
+	if c == 0 {
+		l, r := n.Left, n.Right
+		n = self.mutable(n)
+		n.Left, n.Right = nil, nil
+		updateSubtreeInfo(n)
+		return l, n, r
+	}
+	if c < 0 {
+		l, m, r := self.split(n.Left, word)
+		return l, m, self.join(r, n, n.Right)
+	}
+	l, m, r := self.split(n.Right, word)
+	return self.join(n.Left, n, l), m, r
+}
+
+// Removes the last node from the tree 'n'. Returns the remaining tree and
+// the removed node.
+func (self *treeOp) splitLast(n *node) (*node, *node) {
+	if n.Right == nil {
+		return n.Left, n
+	}
+	rest, last := self.splitLast(n.Right)
+	return self.join(n.Left, n, rest), last
+}
+
+// Concatenates two trees, where every word in 'l' sorts before every word in
+// 'r'.
+func (self *treeOp) join2(l, r *node) *node {
+	if l == nil {
+		return r
+	}
+	rest, last := self.splitLast(l)
+	return self.join(rest, last, r)
+}
+
+// Builds a balanced tree from 'l', then 'k', then 'r', where 'l' and 'r' are
+// balanced trees and every word in 'l' sorts before k's word, which sorts
+// before every word in 'r'. Any existing children of 'k' are discarded.
+func (self *treeOp) join(l, k, r *node) *node {
+	if subtreeHeight(l) > subtreeHeight(r)+1 {
+		return self.joinRight(l, k, r)
+	}
+	if subtreeHeight(r) > subtreeHeight(l)+1 {
+		return self.joinLeft(l, k, r)
+	}
+	k = self.mutable(k)
+	k.Left, k.Right = l, r
+	updateSubtreeInfo(k)
+	return k
+}
+
+// Handles the case of join where 'l' is taller.
+func (self *treeOp) joinRight(l, k, r *node) *node {
+	l = self.mutable(l)
+	c := l.Right
+	if subtreeHeight(c) <= subtreeHeight(r)+1 {
+		k = self.mutable(k)
+		k.Left, k.Right = c, r
+		updateSubtreeInfo(k)
+		if subtreeHeight(k) <= subtreeHeight(l.Left)+1 {
+			l.Right = k
+			updateSubtreeInfo(l)
+			return l
+		}
+		l.Right = self.rotateRight(k)
+		updateSubtreeInfo(l)
+		return self.rotateLeft(l)
+	}
+	l.Right = self.joinRight(c, k, r)
+	updateSubtreeInfo(l)
+	if subtreeHeight(l.Right) <= subtreeHeight(l.Left)+1 {
+		return l
+	}
+	return self.rotateLeft(l)
+}
+
+// Handles the case of join where 'r' is taller.
+func (self *treeOp) joinLeft(l, k, r *node) *node {
+	r = self.mutable(r)
+	c := r.Left
+	if subtreeHeight(c) <= subtreeHeight(l)+1 {
+		k = self.mutable(k)
+		k.Left, k.Right = l, c
+		updateSubtreeInfo(k)
+		if subtreeHeight(k) <= subtreeHeight(r.Right)+1 {
+			r.Left = k
+			updateSubtreeInfo(r)
+			return r
+		}
+		r.Left = self.rotateLeft(k)
+		updateSubtreeInfo(r)
+		return self.rotateRight(r)
+	}
+	r.Left = self.joinLeft(l, k, c)
+	updateSubtreeInfo(r)
+	if subtreeHeight(r.Left) <= subtreeHeight(r.Right)+1 {
+		return r
+	}
+	return self.rotateRight(r)
+}
+
+//     n               p
+//    / \             / \
+//   A   p    ==>    n   C
+//      / \         / \
+//     B   C       A   B
+func (self *treeOp) rotateLeft(n *node) *node {
+	n = self.mutable(n)
+	p := self.mutable(n.Right)
+	n.Right = p.Left
+	p.Left = n
+	updateSubtreeInfo(n)
+	updateSubtreeInfo(p)
+	return p
+}
+
+//     n             p
+//    / \           / \
+//   p   C   ==>   A   n
+//  / \               / \
+// A   B             B   C
+func (self *treeOp) rotateRight(n *node) *node {
+	n = self.mutable(n)
+	p := self.mutable(n.Left)
+	n.Left = p.Right
+	p.Right = n
+	updateSubtreeInfo(n)
+	updateSubtreeInfo(p)
+	return p
+}
@@ -0,0 +1,200 @@
+// Read-only sampler built with Walker's alias method. Sampling from a WordSet
+// walks the tree for every draw; a FrozenWordSet pays O(Size()) once, up
+// front, and then Draw picks each word in O(1). This suits callers which
+// sample many times from the same set, such as bulk game generation.
+//
+// Sampling distinct words is not O(1) per word: see Sample.
+//
+// The table is built with integer arithmetic, so draws follow the words'
+// weights exactly, just as WordSet.Sample does.
+
+package util
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+)
+
+type FrozenWordSet struct {
+	// The words, in alphabetical order.
+	words []WeightedWord
+	// Weight of each word used for sampling, including the node bias.
+	weights []int64
+	// Sum of 'weights'. Each bucket of the table holds this much weight.
+	total int64
+	// Bucket i yields words[i] for the first threshold[i] units of its
+	// weight and words[alias[i]] for the rest.
+	threshold []int64
+	alias     []int
+	// Whether the source set used composite (Word, PartOfSpeech) keys.
+	composite bool
+}
+
+// Builds an alias table from the current contents of this set. 'nodeBias' is
+// added to every word's weight, as for Sample. Returns an error if 'nodeBias'
+// is negative or if the weights are too large to tabulate exactly.
+func (self WordSet) Freeze(nodeBias int64) (*FrozenWordSet, error) {
+	if nodeBias < 0 {
+		return nil, fmt.Errorf("Negative nodeBias: %d", nodeBias)
+	}
+	size := self.Size()
+	f := &FrozenWordSet{
+		make([]WeightedWord, 0, size),
+		make([]int64, 0, size),
+		0,
+		make([]int64, size),
+		make([]int, size),
+		self.composite,
+	}
+	var err error
+	visit(self.root, 0, func(n *node, depth int) {
+		weight := n.Word.Weight + nodeBias
+		if weight < 0 || f.total > math.MaxInt64-weight {
+			err = fmt.Errorf("Total weight is too large to freeze")
+		}
+		f.words = append(f.words, n.Word)
+		f.weights = append(f.weights, weight)
+		f.total += weight
+	})
+	if err != nil {
+		return nil, err
+	}
+	if size > 0 && f.total > math.MaxInt64/size {
+		return nil, fmt.Errorf("Total weight is too large to freeze")
+	}
+	f.build()
+	return f, nil
+}
+
+// Gets the number of words in the table.
+func (self *FrozenWordSet) Size() int64 {
+	return int64(len(self.words))
+}
+
+// Gets the total sampling weight, including the node bias.
+func (self *FrozenWordSet) Weight() int64 {
+	return self.total
+}
+
+// Draws a single word (with replacement), with probability proportional to
+// its weight. Returns false if there is nothing to draw.
+func (self *FrozenWordSet) Draw(r *rand.Rand) (WeightedWord, bool) {
+	if self.total <= 0 {
+		return WeightedWord{}, false
+	}
+	return self.words[self.draw(r)], true
+}
+
+// Draws 'n' distinct words and returns them as a new WordSet, with the same
+// distribution as WordSet.SampleDistinct. Words which have already been drawn
+// are rejected and redrawn, so each word takes O(1) expected draws while the
+// undrawn words hold most of the weight. After that, each word is found by
+// an O(Size()) scan instead, so the worst case is O(n Size()). That happens
+// only when a few heavy words dominate the set, or when 'n' is a large part
+// of Size(); WordSet.SampleDistinct takes O(n log Size()) regardless.
+func (self *FrozenWordSet) Sample(r *rand.Rand, n int64) (WordSet, error) {
+	if n < 0 {
+		return NewWordSet(), fmt.Errorf("Cannot sample %d words", n)
+	}
+	if n > self.Size() {
+		return NewWordSet(), fmt.Errorf(
+			"Cannot sample %d words from a table of size %d", n, self.Size())
+	}
+
+	// Homographs are distinct words in a composite set, so the sample must
+	// use the same key mode to hold them all.
+	sample := WordSet{nil, nil, self.composite}
+	drawn := make(map[int]bool)
+	remaining := self.total
+	for int64(len(drawn)) < n {
+		if remaining <= 0 {
+			return NewWordSet(), fmt.Errorf(
+				"Only %d words have positive weight; cannot sample %d",
+				len(drawn), n)
+		}
+
+		var i int
+		if remaining > self.total/2 {
+			i = self.draw(r)
+			if drawn[i] {
+				continue
+			}
+		} else {
+			i = self.scan(r.Int63n(remaining), drawn)
+		}
+
+		drawn[i] = true
+		remaining -= self.weights[i]
+		if !sample.Insert(self.words[i]) {
+			return NewWordSet(), fmt.Errorf("Word drawn twice: %q",
+				self.words[i].Word)
+		}
+	}
+	return sample, nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// HELPERS
+
+// Fills in 'threshold' and 'alias'. Each word starts with weights[i] * Size()
+// units, and every bucket holds 'total' units.
+func (self *FrozenWordSet) build() {
+	size := int64(len(self.words))
+	small := make([]int, 0)
+	large := make([]int, 0)
+	scaled := make([]int64, size)
+	for i, weight := range self.weights {
+		scaled[i] = weight * size
+		if scaled[i] < self.total {
+			small = append(small, i)
+		} else {
+			large = append(large, i)
+		}
+	}
+
+	for len(small) > 0 && len(large) > 0 {
+		s := small[len(small)-1]
+		small = small[:len(small)-1]
+		l := large[len(large)-1]
+
+		self.threshold[s] = scaled[s]
+		self.alias[s] = l
+		scaled[l] -= self.total - scaled[s]
+		if scaled[l] < self.total {
+			large = large[:len(large)-1]
+			small = append(small, l)
+		}
+	}
+
+	// Whatever is left over is exactly full.
+	for _, i := range append(small, large...) {
+		self.threshold[i] = self.total
+		self.alias[i] = i
+	}
+}
+
+// Draws the index of a word. Requires total > 0.
+func (self *FrozenWordSet) draw(r *rand.Rand) int {
+	i := r.Intn(len(self.words))
+	if r.Int63n(self.total) < self.threshold[i] {
+		return i
+	}
+	return self.alias[i]
+}
+
+// Finds the word containing 'point' when the words not in 'drawn' are laid
+// end to end. 'point' must be less than their total weight.
+func (self *FrozenWordSet) scan(point int64, drawn map[int]bool) int {
+	i := 0
+	for ; i < len(self.weights)-1; i++ {
+		if drawn[i] {
+			continue
+		}
+		if point < self.weights[i] {
+			break
+		}
+		point -= self.weights[i]
+	}
+	return i
+}
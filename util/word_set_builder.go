@@ -1,7 +1,14 @@
 package util
 
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
 // Runs all of the 'tasks' in parallel and returns a WordSet containing their
-// combined outputs.
+// combined outputs. The result uses the key mode of the first task's output.
 func BuildWordSet(tasks []func() WordSet) WordSet {
 	responseChans := make([]chan WordSet, len(tasks))
 	for i := range tasks {
@@ -13,8 +20,165 @@ func BuildWordSet(tasks []func() WordSet) WordSet {
 
 	// Collect outputs from workers.
 	wordSet := NewWordSet()
-	for _, responseChan := range responseChans {
+	for i, responseChan := range responseChans {
+		if i == 0 {
+			wordSet = <-responseChan
+			continue
+		}
 		wordSet.AddAll(<-responseChan)
 	}
 	return wordSet
 }
+
+// A named unit of work for BuildWordSetContext.
+type WordSetTask struct {
+	// Identifies the task in errors and progress reports, such as the name of
+	// the file it reads.
+	Name string
+	Run  func(ctx context.Context) (WordSet, error)
+}
+
+// Like BuildWordSet, but runs at most 'maxParallelism' tasks at once (or all
+// of them, if it is not positive) and stops at the first error, which is
+// returned along with the failing task's name. The context passed to the
+// tasks is cancelled once any task fails or 'ctx' is done. If 'progress' is
+// not nil, it is called after each task succeeds with the task's name, the
+// number of tasks which have succeeded and the total number of tasks. It is
+// called from the calling goroutine.
+//
+// The outputs are merged pairwise with Union, so words from earlier tasks
+// keep their attributes and the result uses the key mode of the first task's
+// output.
+func BuildWordSetContext(ctx context.Context, tasks []WordSetTask,
+	maxParallelism int,
+	progress func(name string, done, total int)) (WordSet, error) {
+	if maxParallelism <= 0 {
+		maxParallelism = len(tasks)
+	}
+	taskCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		index   int
+		wordSet WordSet
+		err     error
+	}
+	// Buffered so that workers never block, even after we stop listening.
+	results := make(chan result, len(tasks))
+
+	outputs := make([]WordSet, len(tasks))
+	var firstErr error = nil
+	next, running, done := 0, 0, 0
+	for {
+		for running < maxParallelism && next < len(tasks) &&
+			firstErr == nil && ctx.Err() == nil {
+			go func(index int) {
+				wordSet, err := tasks[index].Run(taskCtx)
+				results <- result{index, wordSet, err}
+			}(next)
+			next++
+			running++
+		}
+		if running == 0 {
+			break
+		}
+
+		r := <-results
+		running--
+		if r.err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("Task %q failed: %w", tasks[r.index].Name,
+					r.err)
+				cancel()
+			}
+			continue
+		}
+		outputs[r.index] = r.wordSet
+		done++
+		if progress != nil {
+			progress(tasks[r.index].Name, done, len(tasks))
+		}
+	}
+
+	// Prefer reporting our caller's cancellation over the task errors it
+	// caused.
+	if err := ctx.Err(); err != nil {
+		return NewWordSet(), err
+	}
+	if firstErr != nil {
+		return NewWordSet(), firstErr
+	}
+	return mergeWordSets(outputs), nil
+}
+
+// Builds a perfectly balanced WordSet from 'words' in O(n) time. 'words' must
+// be sorted, free of duplicates and have positive weights.
+func NewWordSetFromSorted(words []WeightedWord) (WordSet, error) {
+	for i, word := range words {
+		if word.Weight <= 0 {
+			return NewWordSet(), fmt.Errorf("Nonpositive weight for %q: %d",
+				word.Word, word.Weight)
+		}
+		if i > 0 && strings.Compare(words[i-1].Word, word.Word) >= 0 {
+			return NewWordSet(), fmt.Errorf("Not ordered: %q, %q",
+				words[i-1].Word, word.Word)
+		}
+	}
+	return WordSet{buildBalanced(words, nil), nil, false}, nil
+}
+
+// Builds a WordSet from 'words', which may be in any order and may contain
+// duplicates (whose weights are added, keeping the first known attributes).
+// This sorts a copy of 'words' and then builds the tree in O(n) time,
+// avoiding the rebalancing cost of calling Add once per word.
+func NewWordSetFromSlice(words []WeightedWord) (WordSet, error) {
+	return newWordSetFromSlice(words, false)
+}
+
+// Like NewWordSetFromSlice, but the result uses composite (Word,
+// PartOfSpeech) keys, so only entries with the same part of speech are
+// merged.
+func NewCompositeWordSetFromSlice(words []WeightedWord) (WordSet, error) {
+	return newWordSetFromSlice(words, true)
+}
+
+func newWordSetFromSlice(words []WeightedWord, composite bool) (WordSet, error) {
+	sorted := make([]WeightedWord, len(words))
+	copy(sorted, words)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return compareWords(sorted[i], sorted[j], composite) < 0
+	})
+
+	// Merge duplicates in place.
+	merged := sorted[:0]
+	for _, word := range sorted {
+		if word.Weight <= 0 {
+			return NewWordSet(), fmt.Errorf("Nonpositive weight for %q: %d",
+				word.Word, word.Weight)
+		}
+		last := len(merged) - 1
+		if last >= 0 && compareWords(merged[last], word, composite) == 0 {
+			merged[last].Weight += word.Weight
+			if merged[last].Attributes.IsZero() {
+				merged[last].Attributes = word.Attributes
+			}
+			continue
+		}
+		merged = append(merged, word)
+	}
+	return WordSet{buildBalanced(merged, nil), nil, composite}, nil
+}
+
+// Unions 'wordSets' in a balanced binary tree of merges, so that each word
+// is copied at most O(log len(wordSets)) times.
+func mergeWordSets(wordSets []WordSet) WordSet {
+	switch len(wordSets) {
+	case 0:
+		return NewWordSet()
+	case 1:
+		return wordSets[0]
+	}
+	middle := len(wordSets) / 2
+	return mergeWordSets(wordSets[:middle]).Union(
+		mergeWordSets(wordSets[middle:]), nil)
+}
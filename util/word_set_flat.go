@@ -0,0 +1,430 @@
+// A flat, pointer-free layout for read-only WordSets. Unlike the formats
+// read by DeserializeWordSet, it is queried in place: opening a file maps it
+// into memory (see MapFlatWordSet) without allocating anything per word, so
+// even sets with millions of words load quickly.
+//
+// All integers are little-endian. The layout is:
+//
+//   Header (32 bytes):
+//     4-byte magic "DKWF"
+//     uint32 version (currently 1)
+//     uint32 flags (bit 0: composite keys)
+//     uint32 reserved (zero)
+//     uint64 number of entries
+//     uint64 length of the string pool
+//   Entries (56 bytes each), sorted by key:
+//     uint64 total weight of the preceding entries
+//     int64 weight
+//     uint64 offset of the word in the string pool
+//     uint64 offset of the part of speech in the string pool
+//     uint32 length of the word
+//     uint32 length of the part of speech
+//     int64 rank
+//     float64 dispersion (IEEE 754 bits)
+//   String pool
+
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+var flatMagic = []byte("DKWF")
+
+const (
+	flatVersion       = 1
+	flatFlagComposite = 1
+	flatHeaderSize    = 32
+	flatEntrySize     = 56
+)
+
+// A read-only WordSet backed by a byte slice in the flat layout.
+type FlatWordSet struct {
+	entries   []byte
+	pool      []byte
+	size      int64
+	composite bool
+
+	// Releases the memory behind the slices, if needed.
+	closer func() error
+}
+
+// Writes this set in the flat layout.
+func (self WordSet) WriteFlat(out io.Writer) error {
+	// Lay out the string pool first, since entries refer into it.
+	var pool bytes.Buffer
+	entries := make([]byte, 0, self.Size()*flatEntrySize)
+	var cumulative int64 = 0
+	self.Each(func(word WeightedWord) bool {
+		var entry [flatEntrySize]byte
+		binary.LittleEndian.PutUint64(entry[0:], uint64(cumulative))
+		binary.LittleEndian.PutUint64(entry[8:], uint64(word.Weight))
+		binary.LittleEndian.PutUint64(entry[16:], uint64(pool.Len()))
+		pool.WriteString(word.Word)
+		binary.LittleEndian.PutUint64(entry[24:], uint64(pool.Len()))
+		pool.WriteString(word.Attributes.PartOfSpeech)
+		binary.LittleEndian.PutUint32(entry[32:], uint32(len(word.Word)))
+		binary.LittleEndian.PutUint32(entry[36:],
+			uint32(len(word.Attributes.PartOfSpeech)))
+		binary.LittleEndian.PutUint64(entry[40:], uint64(word.Attributes.Rank))
+		binary.LittleEndian.PutUint64(entry[48:],
+			math.Float64bits(word.Attributes.Dispersion))
+		entries = append(entries, entry[:]...)
+		cumulative += word.Weight
+		return true
+	})
+
+	var header [flatHeaderSize]byte
+	copy(header[0:], flatMagic)
+	binary.LittleEndian.PutUint32(header[4:], flatVersion)
+	if self.composite {
+		binary.LittleEndian.PutUint32(header[8:], flatFlagComposite)
+	}
+	binary.LittleEndian.PutUint64(header[16:], uint64(self.Size()))
+	binary.LittleEndian.PutUint64(header[24:], uint64(pool.Len()))
+
+	buffered := bufio.NewWriter(out)
+	w := &errWriter{buffered, nil}
+	w.Write(header[:])
+	w.Write(entries)
+	w.Write(pool.Bytes())
+	if w.err != nil {
+		return w.err
+	}
+	return buffered.Flush()
+}
+
+// Wraps 'data', which must hold a set in the flat layout. The set refers to
+// 'data' rather than copying it, so 'data' must not change afterwards. Only
+// the header and the overall length are checked, so a mapped file is not
+// read in full; call Check to validate the entries. Queries on a corrupt set
+// never crash, but their results are meaningless.
+func NewFlatWordSet(data []byte) (*FlatWordSet, error) {
+	if len(data) < flatHeaderSize || !bytes.Equal(data[:4], flatMagic) {
+		return nil, fmt.Errorf("Not a flat WordSet")
+	}
+	if version := binary.LittleEndian.Uint32(data[4:]); version != flatVersion {
+		return nil, fmt.Errorf("Unsupported flat WordSet version: %d", version)
+	}
+	flags := binary.LittleEndian.Uint32(data[8:])
+	if flags&^flatFlagComposite != 0 {
+		return nil, fmt.Errorf("Unknown flags: %#x", flags)
+	}
+	size := binary.LittleEndian.Uint64(data[16:])
+	poolLen := binary.LittleEndian.Uint64(data[24:])
+	rest := uint64(len(data) - flatHeaderSize)
+	if size > rest/flatEntrySize || poolLen != rest-size*flatEntrySize {
+		return nil, fmt.Errorf("Bad flat WordSet length")
+	}
+
+	entriesEnd := flatHeaderSize + size*flatEntrySize
+	f := &FlatWordSet{
+		data[flatHeaderSize:entriesEnd],
+		data[entriesEnd:],
+		int64(size),
+		flags&flatFlagComposite != 0,
+		nil,
+	}
+	return f, nil
+}
+
+// Releases the memory behind this set, if it was mapped from a file. The set
+// must not be used afterwards.
+func (self *FlatWordSet) Close() error {
+	if self.closer == nil {
+		return nil
+	}
+	closer := self.closer
+	self.closer = nil
+	return closer()
+}
+
+// Checks that the entries are in bounds, correctly ordered and correctly
+// summed. This reads the whole set.
+func (self *FlatWordSet) Check() error {
+	var cumulative int64 = 0
+	for i := int64(0); i < self.size; i++ {
+		entry := self.entry(i)
+		wordOffset := binary.LittleEndian.Uint64(entry[16:])
+		posOffset := binary.LittleEndian.Uint64(entry[24:])
+		wordLen := uint64(binary.LittleEndian.Uint32(entry[32:]))
+		posLen := uint64(binary.LittleEndian.Uint32(entry[36:]))
+		poolLen := uint64(len(self.pool))
+		if wordOffset > poolLen || wordLen > poolLen-wordOffset ||
+			posOffset > poolLen || posLen > poolLen-posOffset {
+			return fmt.Errorf("Entry %d is out of bounds", i)
+		}
+
+		weight := int64(binary.LittleEndian.Uint64(entry[8:]))
+		if weight <= 0 || cumulative > math.MaxInt64-weight {
+			return fmt.Errorf("Bad weight for entry %d: %d", i, weight)
+		}
+		if int64(binary.LittleEndian.Uint64(entry[0:])) != cumulative {
+			return fmt.Errorf("Bad cumulative weight for entry %d", i)
+		}
+		cumulative += weight
+
+		if i > 0 && self.compareEntries(i-1, i) >= 0 {
+			return fmt.Errorf("Not ordered: %q, %q",
+				self.word(i-1), self.word(i))
+		}
+	}
+	return nil
+}
+
+func (self *FlatWordSet) IsComposite() bool {
+	return self.composite
+}
+
+func (self *FlatWordSet) Size() int64 {
+	return self.size
+}
+
+func (self *FlatWordSet) Weight() int64 {
+	return self.cumulative(self.size)
+}
+
+// Like WordSet.Lookup.
+func (self *FlatWordSet) Lookup(word string) (WeightedWord, bool) {
+	entries := self.Range(word, word+"\x00")
+	if len(entries) == 0 {
+		return WeightedWord{}, false
+	}
+	return mergeEntries(entries), true
+}
+
+// Like WordSet.LookupPos.
+func (self *FlatWordSet) LookupPos(word string,
+	pos string) (WeightedWord, bool) {
+	key := []byte(word)
+	for i := self.Rank(word); i < self.size &&
+		bytes.Equal(self.wordBytes(i), key); i++ {
+		if self.pos(i) == pos {
+			return self.get(i), true
+		}
+	}
+	return WeightedWord{}, false
+}
+
+// Returns the number of words in this set which sort strictly before 'word'.
+func (self *FlatWordSet) Rank(word string) int64 {
+	key := []byte(word)
+	return int64(sort.Search(int(self.size), func(i int) bool {
+		return bytes.Compare(self.wordBytes(int64(i)), key) >= 0
+	}))
+}
+
+// Returns the total weight of the words in this set which sort strictly
+// before 'word'.
+func (self *FlatWordSet) CumulativeWeight(word string) int64 {
+	return self.cumulative(self.Rank(word))
+}
+
+// Returns the word at position 'i' in alphabetical order, counting from 0.
+func (self *FlatWordSet) Select(i int64) (WeightedWord, bool) {
+	if i < 0 || i >= self.size {
+		return WeightedWord{}, false
+	}
+	return self.get(i), true
+}
+
+// Gets the words 'w' in this set with lo <= w < hi, in alphabetical order.
+func (self *FlatWordSet) Range(lo, hi string) []WeightedWord {
+	words := make([]WeightedWord, 0)
+	key := []byte(hi)
+	for i := self.Rank(lo); i < self.size &&
+		bytes.Compare(self.wordBytes(i), key) < 0; i++ {
+		words = append(words, self.get(i))
+	}
+	return words
+}
+
+// Gets the words in this set which start with 'prefix', in alphabetical
+// order.
+func (self *FlatWordSet) Prefix(prefix string) []WeightedWord {
+	words := make([]WeightedWord, 0)
+	key := []byte(prefix)
+	for i := self.Rank(prefix); i < self.size &&
+		bytes.HasPrefix(self.wordBytes(i), key); i++ {
+		words = append(words, self.get(i))
+	}
+	return words
+}
+
+// Gets the contents of this set, sorted by descending weight.
+func (self *FlatWordSet) GetWords() []WeightedWord {
+	words := make([]WeightedWord, self.size)
+	for i := range words {
+		words[i] = self.get(int64(i))
+	}
+	sort.Sort(SortWeightedWords(words))
+	return words
+}
+
+// Calls 'f' for each word in alphabetical order, stopping early if 'f'
+// returns false.
+func (self *FlatWordSet) Each(f func(word WeightedWord) bool) {
+	for i := int64(0); i < self.size; i++ {
+		if !f(self.get(i)) {
+			return
+		}
+	}
+}
+
+// Like WordSet.SampleDistinct, and with the same approach: the entries are
+// treated as an implicit balanced tree, whose subtree weights come from the
+// prefix sums. Each draw costs O(log Size()).
+func (self *FlatWordSet) SampleDistinct(r *rand.Rand, n int64,
+	nodeBias int64) (WordSet, error) {
+	if n < 0 {
+		return NewWordSet(), fmt.Errorf("Cannot sample %d words", n)
+	}
+	if n > self.size {
+		return NewWordSet(), fmt.Errorf(
+			"Cannot sample %d words from a WordSet of size %d", n, self.size)
+	}
+	if nodeBias < 0 {
+		return NewWordSet(), fmt.Errorf("Negative nodeBias: %d", nodeBias)
+	}
+
+	// Total weight of the already-drawn words in each subtree. The subtree
+	// holding entries [lo, hi) is rooted at entry (lo + hi) / 2, which keys
+	// it here.
+	drawn := make(map[int64]int64)
+	remainingWeight := func(lo, hi int64) int64 {
+		if lo >= hi {
+			return 0
+		}
+		return self.cumulative(hi) - self.cumulative(lo) + nodeBias*(hi-lo) -
+			drawn[(lo+hi)/2]
+	}
+
+	sample := NewWordSet()
+	sample.composite = self.composite
+	path := make([]int64, 0, 64)
+	for sample.Size() < n {
+		// Only a corrupt set can run out of weight or fall off the tree.
+		total := remainingWeight(0, self.size)
+		if total <= 0 {
+			return NewWordSet(), fmt.Errorf("Bad weights in flat WordSet")
+		}
+		point := r.Int63n(total)
+		path = path[:0]
+		lo, hi := int64(0), self.size
+		for {
+			if lo >= hi {
+				return NewWordSet(), fmt.Errorf("Bad weights in flat WordSet")
+			}
+			cur := (lo + hi) / 2
+			path = append(path, cur)
+
+			leftWeight := remainingWeight(lo, cur)
+			if point < leftWeight {
+				hi = cur
+				continue
+			}
+			point -= leftWeight
+
+			// This is zero if 'cur' has already been drawn.
+			curWeight := remainingWeight(lo, hi) - leftWeight -
+				remainingWeight(cur+1, hi)
+			if point < curWeight {
+				if !sample.Insert(self.get(cur)) {
+					return NewWordSet(), fmt.Errorf("Repeated word in flat WordSet")
+				}
+				for _, p := range path {
+					drawn[p] += curWeight
+				}
+				break
+			}
+			point -= curWeight
+
+			lo = cur + 1
+		}
+	}
+	return sample, nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// HELPERS
+
+func (self *FlatWordSet) entry(i int64) []byte {
+	return self.entries[i*flatEntrySize : (i+1)*flatEntrySize]
+}
+
+// Gets the word of entry 'i' without copying it.
+func (self *FlatWordSet) wordBytes(i int64) []byte {
+	entry := self.entry(i)
+	return self.poolSlice(binary.LittleEndian.Uint64(entry[16:]),
+		uint64(binary.LittleEndian.Uint32(entry[32:])))
+}
+
+func (self *FlatWordSet) word(i int64) string {
+	return string(self.wordBytes(i))
+}
+
+func (self *FlatWordSet) posBytes(i int64) []byte {
+	entry := self.entry(i)
+	return self.poolSlice(binary.LittleEndian.Uint64(entry[24:]),
+		uint64(binary.LittleEndian.Uint32(entry[36:])))
+}
+
+// Gets the given part of the string pool, or nil if it is out of bounds.
+// Entries are not checked up front, so this must not trust them.
+func (self *FlatWordSet) poolSlice(offset, length uint64) []byte {
+	poolLen := uint64(len(self.pool))
+	if offset > poolLen || length > poolLen-offset {
+		return nil
+	}
+	return self.pool[offset : offset+length]
+}
+
+func (self *FlatWordSet) pos(i int64) string {
+	return string(self.posBytes(i))
+}
+
+// Compares entries 'i' and 'j' by this set's key, without copying them.
+func (self *FlatWordSet) compareEntries(i, j int64) int {
+	c := bytes.Compare(self.wordBytes(i), self.wordBytes(j))
+	if c != 0 || !self.composite {
+		return c
+	}
+	return bytes.Compare(self.posBytes(i), self.posBytes(j))
+}
+
+func (self *FlatWordSet) weight(i int64) int64 {
+	return int64(binary.LittleEndian.Uint64(self.entry(i)[8:]))
+}
+
+func (self *FlatWordSet) get(i int64) WeightedWord {
+	entry := self.entry(i)
+	return WeightedWord{
+		self.word(i),
+		self.weight(i),
+		WordAttributes{
+			self.pos(i),
+			int64(binary.LittleEndian.Uint64(entry[40:])),
+			math.Float64frombits(binary.LittleEndian.Uint64(entry[48:])),
+		},
+	}
+}
+
+// Gets the total weight of the entries before 'i'. 'i' may equal Size().
+func (self *FlatWordSet) cumulative(i int64) int64 {
+	if i == self.size {
+		if i == 0 {
+			return 0
+		}
+		last := self.entry(i - 1)
+		return int64(binary.LittleEndian.Uint64(last[0:])) +
+			int64(binary.LittleEndian.Uint64(last[8:]))
+	}
+	return int64(binary.LittleEndian.Uint64(self.entry(i)[0:]))
+}
@@ -0,0 +1,43 @@
+//go:build darwin || freebsd || linux || netbsd || openbsd
+// +build darwin freebsd linux netbsd openbsd
+
+package util
+
+import (
+	"os"
+	"syscall"
+)
+
+// Maps the flat WordSet in 'filename' into memory, read-only. Call Close to
+// unmap it.
+func MapFlatWordSet(filename string) (*FlatWordSet, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() == 0 {
+		// Mapping an empty file fails; report it as a bad file instead.
+		return NewFlatWordSet(nil)
+	}
+	data, err := syscall.Mmap(int(file.Fd()), 0, int(info.Size()),
+		syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := NewFlatWordSet(data)
+	if err != nil {
+		syscall.Munmap(data)
+		return nil, err
+	}
+	f.closer = func() error {
+		return syscall.Munmap(data)
+	}
+	return f, nil
+}
@@ -0,0 +1,18 @@
+//go:build !darwin && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!freebsd,!linux,!netbsd,!openbsd
+
+package util
+
+import (
+	"io/ioutil"
+)
+
+// Reads the flat WordSet in 'filename' into memory. On this platform the
+// file is read rather than mapped, so Close does nothing.
+func MapFlatWordSet(filename string) (*FlatWordSet, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return NewFlatWordSet(data)
+}
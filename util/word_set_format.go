@@ -0,0 +1,374 @@
+// Binary formats for serialized WordSets.
+//
+// The legacy v1 format has no header. It is a pre-order walk of the tree,
+// where each node is written as:
+//   int8 tag (0 for a nil node, 1 otherwise)
+//   int64 weight, int64 word length, word bytes (only if tag is 1)
+// with all integers little-endian.
+//
+// The v2 format is:
+//   4-byte magic "DKWS"
+//   uvarint version (2)
+//   uvarint flags (bit 0 is set for composite keys)
+//   uvarint word count
+//   for each word, in sorted order: uvarint weight, uvarint word length,
+//     word bytes, uvarint part of speech length, part of speech bytes,
+//     uvarint rank, dispersion as little-endian float64 bits
+//   CRC-32 (IEEE) of all preceding bytes, as a little-endian uint32
+//
+// v2 files can be told apart from v1 files because the first byte of the
+// magic is never a valid v1 tag.
+
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math"
+)
+
+var byteOrder = binary.LittleEndian
+
+var v2Magic = []byte("DKWS")
+
+const v2Version = 2
+
+// Flag bits for the v2 format.
+const v2FlagComposite = 1
+
+// Longest word we are willing to read. This keeps corrupt or malicious input
+// from making us allocate huge buffers.
+const maxSerializedWordLen = 1 << 16
+
+// Deepest tree we are willing to read in the v1 format. No AVL tree with
+// fewer than 2^63 nodes is this tall.
+const maxV1Depth = 128
+
+func serializeV2(out io.Writer, words WordSet) error {
+	buffered := bufio.NewWriter(out)
+	crc := crc32.NewIEEE()
+	w := &errWriter{io.MultiWriter(buffered, crc), nil}
+
+	w.Write(v2Magic)
+	w.writeUvarint(v2Version)
+	var flags uint64 = 0
+	if words.composite {
+		flags |= v2FlagComposite
+	}
+	w.writeUvarint(flags)
+	w.writeUvarint(uint64(words.Size()))
+	visit(words.root, 0, func(n *node, depth int) {
+		w.writeUvarint(uint64(n.Word.Weight))
+		w.writeUvarint(uint64(len(n.Word.Word)))
+		w.Write([]byte(n.Word.Word))
+
+		attributes := n.Word.Attributes
+		w.writeUvarint(uint64(len(attributes.PartOfSpeech)))
+		w.Write([]byte(attributes.PartOfSpeech))
+		if attributes.Rank < 0 && w.err == nil {
+			w.err = fmt.Errorf("Negative rank for %q: %d", n.Word.Word,
+				attributes.Rank)
+		}
+		w.writeUvarint(uint64(attributes.Rank))
+		binary.Write(w, byteOrder, math.Float64bits(attributes.Dispersion))
+	})
+	if w.err != nil {
+		return w.err
+	}
+
+	if err := binary.Write(buffered, byteOrder, crc.Sum32()); err != nil {
+		return err
+	}
+	return buffered.Flush()
+}
+
+// Reads either format, dispatching on the first byte.
+func deserialize(in io.Reader) (*WordSet, error) {
+	r := newCrcReader(in)
+
+	first, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if first == 0 || first == 1 {
+		root, err := deserializeV1(r, int8(first))
+		if err != nil {
+			return nil, fmt.Errorf("%v. Read so far:\n%s", err, prettyPrint(root))
+		}
+		return &WordSet{root, nil, false}, nil
+	}
+
+	magic := make([]byte, len(v2Magic))
+	magic[0] = first
+	if _, err = io.ReadFull(r, magic[1:]); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(magic, v2Magic) {
+		return nil, fmt.Errorf("Bad magic: %q", magic)
+	}
+	return deserializeV2(r)
+}
+
+func deserializeV2(r *crcReader) (*WordSet, error) {
+	version, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if version != v2Version {
+		return nil, fmt.Errorf("Unsupported version: %d", version)
+	}
+
+	flags, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if flags&^v2FlagComposite != 0 {
+		return nil, fmt.Errorf("Unknown flags: %x", flags)
+	}
+	composite := flags&v2FlagComposite != 0
+
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// We don't trust 'count' enough to preallocate based on it.
+	words := make([]WeightedWord, 0)
+	for i := uint64(0); i < count; i++ {
+		weight, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		if weight == 0 || weight > 1<<63-1 {
+			return nil, fmt.Errorf("Bad weight: %d", weight)
+		}
+
+		word, err := readUvarintWord(r)
+		if err != nil {
+			return nil, err
+		}
+
+		attributes, err := readAttributes(r)
+		if err != nil {
+			return nil, err
+		}
+
+		entry := WeightedWord{word, int64(weight), attributes}
+		if len(words) > 0 &&
+			compareWords(words[len(words)-1], entry, composite) >= 0 {
+			return nil, errors.New("Not ordered")
+		}
+		words = append(words, entry)
+	}
+
+	expectedCrc := r.crc.Sum32()
+	var actualCrc uint32
+	if err := binary.Read(r, byteOrder, &actualCrc); err != nil {
+		return nil, err
+	}
+	if actualCrc != expectedCrc {
+		return nil, fmt.Errorf("Bad checksum: expected %08x, got %08x",
+			expectedCrc, actualCrc)
+	}
+
+	return &WordSet{buildBalanced(words, nil), nil, composite}, nil
+}
+
+// Reads a word preceded by its uvarint length.
+func readUvarintWord(r *crcReader) (string, error) {
+	wordLen, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	if wordLen > maxSerializedWordLen {
+		return "", fmt.Errorf("Bad word length: %d", wordLen)
+	}
+	return readWord(r, int64(wordLen))
+}
+
+func readAttributes(r *crcReader) (WordAttributes, error) {
+	var attributes WordAttributes
+	var err error
+
+	if attributes.PartOfSpeech, err = readUvarintWord(r); err != nil {
+		return attributes, err
+	}
+
+	rank, err := binary.ReadUvarint(r)
+	if err != nil {
+		return attributes, err
+	}
+	if rank > 1<<63-1 {
+		return attributes, fmt.Errorf("Bad rank: %d", rank)
+	}
+	attributes.Rank = int64(rank)
+
+	var dispersionBits uint64
+	if err = binary.Read(r, byteOrder, &dispersionBits); err != nil {
+		return attributes, err
+	}
+	attributes.Dispersion = math.Float64frombits(dispersionBits)
+
+	return attributes, nil
+}
+
+// Reads the rest of a v1 stream whose first tag has already been read. This
+// uses an explicit stack rather than recursion, so deep input cannot
+// overflow the goroutine stack. On error, returns whatever was read so far.
+func deserializeV1(r *crcReader, tag int8) (*node, error) {
+	root, err := readV1Node(r, tag)
+	if root == nil || err != nil {
+		return root, err
+	}
+
+	// Each entry is a node together with the number of its children which
+	// have been read.
+	type frame struct {
+		n        *node
+		children int
+	}
+	stack := []frame{{root, 0}}
+
+	for len(stack) > 0 {
+		top := &stack[len(stack)-1]
+		if top.children == 2 {
+			updateSubtreeInfo(top.n)
+			stack = stack[:len(stack)-1]
+			continue
+		}
+
+		if err = binary.Read(r, byteOrder, &tag); err == nil {
+			var child *node
+			child, err = readV1Node(r, tag)
+			if top.children == 0 {
+				top.n.Left = child
+			} else {
+				top.n.Right = child
+			}
+			top.children++
+			if child != nil {
+				if len(stack) >= maxV1Depth {
+					err = fmt.Errorf("Tree deeper than %d", maxV1Depth)
+				} else {
+					stack = append(stack, frame{child, 0})
+				}
+			}
+		}
+
+		if err != nil {
+			// Fix up the subtree info for the partial tree before returning it.
+			for i := len(stack) - 1; i >= 0; i-- {
+				updateSubtreeInfo(stack[i].n)
+			}
+			return root, err
+		}
+	}
+	return root, nil
+}
+
+// Reads the body of a v1 node with the given tag. Returns nil for a nil tag.
+func readV1Node(r io.Reader, tag int8) (*node, error) {
+	if tag == 0 {
+		return nil, nil
+	}
+	if tag != 1 {
+		return nil, fmt.Errorf("Bad tag: %d", tag)
+	}
+
+	var weight int64
+	if err := binary.Read(r, byteOrder, &weight); err != nil {
+		return nil, err
+	}
+
+	var wordLen int64
+	if err := binary.Read(r, byteOrder, &wordLen); err != nil {
+		return nil, err
+	}
+	word, err := readWord(r, wordLen)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &node{nil, nil, WeightedWord{Word: word, Weight: weight}, 0, 0, 0, 0, nil}
+	updateSubtreeInfo(n)
+	return n, nil
+}
+
+// Reads a word of length 'wordLen', after checking that the length is sane.
+func readWord(r io.Reader, wordLen int64) (string, error) {
+	if wordLen < 0 || wordLen > maxSerializedWordLen {
+		return "", fmt.Errorf("Bad word length: %d", wordLen)
+	}
+	word := make([]byte, wordLen)
+	if _, err := io.ReadFull(r, word); err != nil {
+		return "", err
+	}
+	return string(word), nil
+}
+
+// Builds a perfectly balanced tree from 'words', which must be sorted and
+// free of duplicates. New nodes are given the specified owner.
+func buildBalanced(words []WeightedWord, owner *ownerToken) *node {
+	if len(words) == 0 {
+		return nil
+	}
+	mid := len(words) / 2
+	n := newLeafNode(words[mid], owner)
+	n.Left = buildBalanced(words[:mid], owner)
+	n.Right = buildBalanced(words[mid+1:], owner)
+	updateSubtreeInfo(n)
+	return n
+}
+
+// Wraps an io.Writer, remembering the first error so that a sequence of
+// writes can be checked once at the end.
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (self *errWriter) Write(p []byte) (int, error) {
+	if self.err != nil {
+		return 0, self.err
+	}
+	var n int
+	n, self.err = self.w.Write(p)
+	return n, self.err
+}
+
+func (self *errWriter) writeUvarint(x uint64) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	self.Write(buf[:binary.PutUvarint(buf, x)])
+}
+
+// Wraps an io.Reader, computing a CRC of everything read and providing
+// io.ByteReader. It never reads ahead of what the caller asks for, so the
+// underlying reader is left positioned just past the WordSet.
+type crcReader struct {
+	r   io.Reader
+	crc hash.Hash32
+	buf [1]byte
+}
+
+func newCrcReader(r io.Reader) *crcReader {
+	return &crcReader{r, crc32.NewIEEE(), [1]byte{}}
+}
+
+func (self *crcReader) Read(p []byte) (int, error) {
+	n, err := self.r.Read(p)
+	self.crc.Write(p[:n])
+	return n, err
+}
+
+func (self *crcReader) ReadByte() (byte, error) {
+	if _, err := io.ReadFull(self, self.buf[:]); err != nil {
+		return 0, err
+	}
+	return self.buf[0], nil
+}
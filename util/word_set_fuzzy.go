@@ -0,0 +1,142 @@
+// Fuzzy lookup over the words of a WordSet, for recognizing misspellings.
+// Words are kept in a BK-tree keyed by Levenshtein distance: each child
+// edge is labelled with the child's distance from its parent, so the
+// triangle inequality lets a query skip every edge whose label is more than
+// 'maxDistance' away from the query's own distance to the parent.
+
+package util
+
+import (
+	"sort"
+)
+
+// A word within some edit distance of a query.
+type FuzzyMatch struct {
+	Word     WeightedWord
+	Distance int
+}
+
+type FuzzyIndex struct {
+	root *bkNode
+	size int64
+}
+
+type bkNode struct {
+	word WeightedWord
+	// Keyed by the child's distance from 'word'.
+	children map[int]*bkNode
+}
+
+// Builds a FuzzyIndex over the words of 'set'. Composite sets are aggregated
+// first, so each spelling appears once.
+func NewFuzzyIndex(set WordSet) *FuzzyIndex {
+	set = set.Aggregate()
+	index := &FuzzyIndex{}
+	set.Each(func(word WeightedWord) bool {
+		index.add(word)
+		return true
+	})
+	return index
+}
+
+// Gets the number of words in the index.
+func (self *FuzzyIndex) Size() int64 {
+	return self.size
+}
+
+// Finds the words within edit distance 'maxDistance' of 'word', closest
+// first. Words at the same distance are ordered by descending weight, and
+// then alphabetically.
+func (self *FuzzyIndex) Lookup(word string, maxDistance int) []FuzzyMatch {
+	matches := make([]FuzzyMatch, 0)
+	if self.root == nil || maxDistance < 0 {
+		return matches
+	}
+	query := []rune(word)
+
+	pending := []*bkNode{self.root}
+	for len(pending) > 0 {
+		n := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		d := editDistance(query, []rune(n.word.Word))
+		if d <= maxDistance {
+			matches = append(matches, FuzzyMatch{n.word, d})
+		}
+		for edge, child := range n.children {
+			if edge >= d-maxDistance && edge <= d+maxDistance {
+				pending = append(pending, child)
+			}
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		a, b := matches[i], matches[j]
+		if a.Distance != b.Distance {
+			return a.Distance < b.Distance
+		}
+		if a.Word.Weight != b.Word.Weight {
+			return a.Word.Weight > b.Word.Weight
+		}
+		return a.Word.Word < b.Word.Word
+	})
+	return matches
+}
+
+// Computes the Levenshtein distance between 'a' and 'b': the fewest
+// single-character insertions, deletions and substitutions which turn one
+// into the other. Characters are Unicode code points.
+func EditDistance(a, b string) int {
+	return editDistance([]rune(a), []rune(b))
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// HELPERS
+
+func (self *FuzzyIndex) add(word WeightedWord) {
+	self.size++
+	if self.root == nil {
+		self.root = &bkNode{word, make(map[int]*bkNode)}
+		return
+	}
+	runes := []rune(word.Word)
+	n := self.root
+	for {
+		d := editDistance(runes, []rune(n.word.Word))
+		child, ok := n.children[d]
+		if !ok {
+			n.children[d] = &bkNode{word, make(map[int]*bkNode)}
+			return
+		}
+		n = child
+	}
+}
+
+// Uses a single row of the dynamic programming table.
+func editDistance(a, b []rune) int {
+	row := make([]int, len(b)+1)
+	for j := range row {
+		row[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		// The value of row[j-1] from the previous row.
+		diagonal := row[0]
+		row[0] = i
+		for j := 1; j <= len(b); j++ {
+			substitute := diagonal
+			if a[i-1] != b[j-1] {
+				substitute++
+			}
+			diagonal = row[j]
+			row[j] = minInt(substitute, minInt(row[j], row[j-1])+1)
+		}
+	}
+	return row[len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
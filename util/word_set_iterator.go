@@ -0,0 +1,157 @@
+// Streaming iteration over WordSets. Unlike GetWords, these never copy the
+// whole set: the alphabetical iterators hold one path through the tree, and
+// the weight-order iterator only expands the subtrees it needs.
+//
+// An iterator reads the tree as it was when the iterator was created, but
+// only if the set is not modified in place meanwhile. Iterate over a
+// Snapshot if the set may change.
+
+package util
+
+import (
+	"container/heap"
+)
+
+// Calls 'f' for each word in alphabetical order, stopping early if 'f'
+// returns false.
+func (self WordSet) Each(f func(word WeightedWord) bool) {
+	each(self.root, f)
+}
+
+// Steps through a WordSet in alphabetical order.
+type WordSetIterator struct {
+	// Nodes whose words (and right subtrees) are yet to be visited. The next
+	// word is at the top.
+	stack []*node
+}
+
+// Returns an iterator positioned at the first word of this set.
+func (self WordSet) Iterator() *WordSetIterator {
+	it := &WordSetIterator{make([]*node, 0, subtreeHeight(self.root))}
+	it.pushLeft(self.root)
+	return it
+}
+
+// Returns an iterator positioned at the first word which is not less than
+// 'word'.
+func (self WordSet) IteratorFrom(word string) *WordSetIterator {
+	it := &WordSetIterator{make([]*node, 0, subtreeHeight(self.root))}
+	for n := self.root; n != nil; {
+		if n.Word.Word >= word {
+			it.stack = append(it.stack, n)
+			n = n.Left
+		} else {
+			n = n.Right
+		}
+	}
+	return it
+}
+
+// Returns the next word, or false once the iterator is exhausted.
+func (self *WordSetIterator) Next() (WeightedWord, bool) {
+	if len(self.stack) == 0 {
+		return WeightedWord{}, false
+	}
+	n := self.stack[len(self.stack)-1]
+	self.stack = self.stack[:len(self.stack)-1]
+	self.pushLeft(n.Right)
+	return n.Word, true
+}
+
+// Steps through a WordSet by descending weight, in the same order as
+// GetWords. Each step costs O(log Size()) amortized, and the iterator holds
+// O(k log Size()) nodes after k steps.
+type WeightIterator struct {
+	pending weightHeap
+}
+
+// Returns an iterator positioned at the heaviest word of this set.
+func (self WordSet) ByWeight() *WeightIterator {
+	it := &WeightIterator{make(weightHeap, 0)}
+	if self.root != nil {
+		it.pending = append(it.pending, weightEntry{self.root, true})
+	}
+	return it
+}
+
+// Returns the next word, or false once the iterator is exhausted.
+func (self *WeightIterator) Next() (WeightedWord, bool) {
+	for len(self.pending) > 0 {
+		entry := heap.Pop(&self.pending).(weightEntry)
+		if !entry.subtree {
+			return entry.n.Word, true
+		}
+		heap.Push(&self.pending, weightEntry{entry.n, false})
+		for _, child := range []*node{entry.n.Left, entry.n.Right} {
+			if child != nil {
+				heap.Push(&self.pending, weightEntry{child, true})
+			}
+		}
+	}
+	return WeightedWord{}, false
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// HELPERS
+
+// Returns false if 'f' asked to stop.
+func each(n *node, f func(word WeightedWord) bool) bool {
+	if n == nil {
+		return true
+	}
+	return each(n.Left, f) && f(n.Word) && each(n.Right, f)
+}
+
+func (self *WordSetIterator) pushLeft(n *node) {
+	for ; n != nil; n = n.Left {
+		self.stack = append(self.stack, n)
+	}
+}
+
+// Either a single word or a whole subtree which has not been expanded yet.
+type weightEntry struct {
+	n       *node
+	subtree bool
+}
+
+func (self weightEntry) weight() int64 {
+	if self.subtree {
+		return self.n.SubtreeMaxWeight
+	}
+	return self.n.Word.Weight
+}
+
+// Max-heap ordered like SortWeightedWords. A subtree sorts ahead of a word
+// of the same weight, so that any word it holds with that weight is
+// expanded before the tie is broken.
+type weightHeap []weightEntry
+
+func (self weightHeap) Len() int {
+	return len(self)
+}
+
+func (self weightHeap) Less(i, j int) bool {
+	a, b := self[i], self[j]
+	if a.weight() != b.weight() {
+		return a.weight() > b.weight()
+	}
+	if a.subtree != b.subtree {
+		return a.subtree
+	}
+	return compareWords(a.n.Word, b.n.Word, true) < 0
+}
+
+func (self weightHeap) Swap(i, j int) {
+	self[i], self[j] = self[j], self[i]
+}
+
+func (self *weightHeap) Push(x interface{}) {
+	*self = append(*self, x.(weightEntry))
+}
+
+func (self *weightHeap) Pop() interface{} {
+	old := *self
+	x := old[len(old)-1]
+	*self = old[:len(old)-1]
+	return x
+}
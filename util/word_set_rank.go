@@ -0,0 +1,116 @@
+// Queries by frequency rank. A WordSet is ordered alphabetically, so these
+// are answered by a WeightIndex: a read-only copy of the words sorted by
+// descending weight (the order of GetWords), built once in O(n log n) and
+// then queried in O(1) or O(log n) per call.
+//
+// A word's rank is its position in that order, so the heaviest word has
+// rank 0.
+
+package util
+
+import (
+	"math"
+	"sort"
+)
+
+type WeightIndex struct {
+	// The words, in GetWords order.
+	words []WeightedWord
+	// Key mode of the indexed set.
+	composite bool
+}
+
+// Builds a WeightIndex from the current contents of this set.
+func (self WordSet) IndexByWeight() *WeightIndex {
+	return &WeightIndex{self.GetWords(), self.composite}
+}
+
+// Gets the 'k' heaviest words of this set, in GetWords order. This does not
+// need an index: it costs O(k log Size()).
+func (self WordSet) TopK(k int64) []WeightedWord {
+	words := make([]WeightedWord, 0)
+	it := self.ByWeight()
+	for int64(len(words)) < k {
+		word, ok := it.Next()
+		if !ok {
+			break
+		}
+		words = append(words, word)
+	}
+	return words
+}
+
+// Gets the number of words in the index.
+func (self *WeightIndex) Size() int64 {
+	return int64(len(self.words))
+}
+
+// Gets the 'k' heaviest words.
+func (self *WeightIndex) TopK(k int64) []WeightedWord {
+	return self.ByRankRange(0, k)
+}
+
+// Gets the words with ranks in [lo, hi), heaviest first. The bounds are
+// clamped to [0, Size()].
+func (self *WeightIndex) ByRankRange(lo, hi int64) []WeightedWord {
+	lo, hi = self.clamp(lo, hi)
+	words := make([]WeightedWord, hi-lo)
+	copy(words, self.words[lo:hi])
+	return words
+}
+
+// Gets the rank of the heaviest word whose weight is at most 'weight'. This
+// is Size() if every word is heavier.
+func (self *WeightIndex) RankOfWeight(weight int64) int64 {
+	return int64(sort.Search(len(self.words), func(i int) bool {
+		return self.words[i].Weight <= weight
+	}))
+}
+
+// Gets the word weight at quantile 'q', which must be in [0, 1]: the
+// smallest weight such that at least a fraction 'q' of the words weigh no
+// more than it. WeightQuantile(0.5) is the median weight. Returns false if
+// the index is empty or 'q' is out of range.
+func (self *WeightIndex) WeightQuantile(q float64) (int64, bool) {
+	size := len(self.words)
+	if size == 0 || !(q >= 0 && q <= 1) {
+		return 0, false
+	}
+	// The number of words which must weigh no more than the result.
+	below := int(math.Ceil(q * float64(size)))
+	if below < 1 {
+		below = 1
+	}
+	return self.words[size-below].Weight, true
+}
+
+// Makes a new WordSet from the words with ranks in [lo, hi), which uses the
+// same key mode as the indexed set. For example, Band(1000, 3000) holds the
+// words ranked 1000 to 2999 by frequency, ready to be sampled.
+func (self *WeightIndex) Band(lo, hi int64) WordSet {
+	words := self.ByRankRange(lo, hi)
+	sort.Slice(words, func(i, j int) bool {
+		return compareWords(words[i], words[j], self.composite) < 0
+	})
+	return WordSet{buildBalanced(words, nil), nil, self.composite}
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// HELPERS
+
+func (self *WeightIndex) clamp(lo, hi int64) (int64, int64) {
+	size := self.Size()
+	if lo < 0 {
+		lo = 0
+	}
+	if lo > size {
+		lo = size
+	}
+	if hi < lo {
+		hi = lo
+	}
+	if hi > size {
+		hi = size
+	}
+	return lo, hi
+}
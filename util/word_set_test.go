@@ -2,8 +2,17 @@ package util_test
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
   "math/rand"
+	"os"
 	"strings"
+	"sync/atomic"
 	"testing"
 )
 import . "github.com/sethpollen/dorkalonius/util"
@@ -26,7 +35,7 @@ func TestBasic(t *testing.T) {
 
 	for i, word := range strings.Split(
 		"and again the quick brown fox jumps over the lazy dog", " ") {
-		w.Add(WeightedWord{word, int64(i + 1)})
+		w.Add(WeightedWord{Word: word, Weight: int64(i + 1)})
 
 		if err := w.Check(); err != nil {
 			t.Error(err)
@@ -65,32 +74,32 @@ func TestBasic(t *testing.T) {
 		t.Errorf("len(words): expected %d, got %d", 10, len(words))
 	}
 	for i, expected := range []WeightedWord{
-		WeightedWord{"the", 12},
-		WeightedWord{"dog", 11},
-		WeightedWord{"lazy", 10},
-		WeightedWord{"over", 8},
-		WeightedWord{"jumps", 7},
-		WeightedWord{"fox", 6},
-		WeightedWord{"brown", 5},
-		WeightedWord{"quick", 4},
-		WeightedWord{"again", 2},
-		WeightedWord{"and", 1},
+		WeightedWord{Word: "the", Weight: 12},
+		WeightedWord{Word: "dog", Weight: 11},
+		WeightedWord{Word: "lazy", Weight: 10},
+		WeightedWord{Word: "over", Weight: 8},
+		WeightedWord{Word: "jumps", Weight: 7},
+		WeightedWord{Word: "fox", Weight: 6},
+		WeightedWord{Word: "brown", Weight: 5},
+		WeightedWord{Word: "quick", Weight: 4},
+		WeightedWord{Word: "again", Weight: 2},
+		WeightedWord{Word: "and", Weight: 1},
 	} {
 		if words[i] != expected {
-			t.Errorf("words[%d]: expected %q, got %q", i, expected, words[i])
+			t.Errorf("words[%d]: expected %v, got %v", i, expected, words[i])
 		}
 	}
 }
 
 func TestInsert(t *testing.T) {
 	w := NewWordSet()
-	if !w.Insert(WeightedWord{"foo", 1}) {
+	if !w.Insert(WeightedWord{Word: "foo", Weight: 1}) {
 		t.Error("Wrong Insert return value")
 	}
-	if !w.Insert(WeightedWord{"bar", 1}) {
+	if !w.Insert(WeightedWord{Word: "bar", Weight: 1}) {
 		t.Error("Wrong Insert return value")
 	}
-	if w.Insert(WeightedWord{"foo", 1}) {
+	if w.Insert(WeightedWord{Word: "foo", Weight: 1}) {
 		t.Error("Wrong Insert return value")
 	}
 	if w.Size() != 2 {
@@ -103,16 +112,16 @@ func TestInsert(t *testing.T) {
 
 func TestAddAll(t *testing.T) {
 	w1 := NewWordSet()
-	w1.Add(WeightedWord{"a", 1})
-	w1.Add(WeightedWord{"b", 3})
-	w1.Add(WeightedWord{"c", 10})
-	w1.Add(WeightedWord{"d", 15})
+	w1.Add(WeightedWord{Word: "a", Weight: 1})
+	w1.Add(WeightedWord{Word: "b", Weight: 3})
+	w1.Add(WeightedWord{Word: "c", Weight: 10})
+	w1.Add(WeightedWord{Word: "d", Weight: 15})
 
 	w2 := NewWordSet()
-	w2.Add(WeightedWord{"a", 15})
-	w2.Add(WeightedWord{"b", 4})
-	w2.Add(WeightedWord{"e", 1})
-	w2.Add(WeightedWord{"f", 12})
+	w2.Add(WeightedWord{Word: "a", Weight: 15})
+	w2.Add(WeightedWord{Word: "b", Weight: 4})
+	w2.Add(WeightedWord{Word: "e", Weight: 1})
+	w2.Add(WeightedWord{Word: "f", Weight: 12})
 
 	w1.AddAll(w2)
 	if err := w1.Check(); err != nil {
@@ -121,28 +130,724 @@ func TestAddAll(t *testing.T) {
 	}
 
 	expected := NewWordSet()
-	expected.Add(WeightedWord{"a", 16})
-	expected.Add(WeightedWord{"b", 7})
-	expected.Add(WeightedWord{"c", 10})
-	expected.Add(WeightedWord{"d", 15})
-	expected.Add(WeightedWord{"e", 1})
-	expected.Add(WeightedWord{"f", 12})
+	expected.Add(WeightedWord{Word: "a", Weight: 16})
+	expected.Add(WeightedWord{Word: "b", Weight: 7})
+	expected.Add(WeightedWord{Word: "c", Weight: 10})
+	expected.Add(WeightedWord{Word: "d", Weight: 15})
+	expected.Add(WeightedWord{Word: "e", Weight: 1})
+	expected.Add(WeightedWord{Word: "f", Weight: 12})
 
 	if !wordSetsEqual(expected, w1) {
 		t.Error()
 	}
 }
 
+func TestRemove(t *testing.T) {
+	w := NewWordSet()
+	for i, word := range strings.Split(
+		"and again the quick brown fox jumps over the lazy dog", " ") {
+		w.Add(WeightedWord{Word: word, Weight: int64(i + 1)})
+	}
+
+	if w.Remove("cat") {
+		t.Error("Wrong Remove return value")
+	}
+	for _, word := range []string{"quick", "and", "the", "lazy"} {
+		if !w.Remove(word) {
+			t.Error("Wrong Remove return value")
+		}
+		if err := w.Check(); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	if w.Remove("quick") {
+		t.Error("Wrong Remove return value")
+	}
+
+	expected := NewWordSet()
+	expected.Add(WeightedWord{Word: "again", Weight: 2})
+	expected.Add(WeightedWord{Word: "brown", Weight: 5})
+	expected.Add(WeightedWord{Word: "fox", Weight: 6})
+	expected.Add(WeightedWord{Word: "jumps", Weight: 7})
+	expected.Add(WeightedWord{Word: "over", Weight: 8})
+	expected.Add(WeightedWord{Word: "dog", Weight: 11})
+
+	if !wordSetsEqual(expected, w) {
+		t.Error()
+	}
+}
+
+func TestSubtract(t *testing.T) {
+	w := NewWordSet()
+	w.Add(WeightedWord{Word: "a", Weight: 5})
+	w.Add(WeightedWord{Word: "b", Weight: 3})
+	w.Add(WeightedWord{Word: "c", Weight: 1})
+
+	if w.Subtract(WeightedWord{Word: "d", Weight: 1}) {
+		t.Error("Wrong Subtract return value")
+	}
+	if !w.Subtract(WeightedWord{Word: "a", Weight: 2}) {
+		t.Error("Wrong Subtract return value")
+	}
+	if !w.Subtract(WeightedWord{Word: "b", Weight: 3}) {
+		t.Error("Wrong Subtract return value")
+	}
+	if !w.Subtract(WeightedWord{Word: "c", Weight: 10}) {
+		t.Error("Wrong Subtract return value")
+	}
+	if err := w.Check(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	expected := NewWordSet()
+	expected.Add(WeightedWord{Word: "a", Weight: 3})
+
+	if !wordSetsEqual(expected, w) {
+		t.Error()
+	}
+	if w.Weight() != 3 {
+		t.Errorf("Weight: expected %d, got %d", 3, w.Weight())
+	}
+}
+
+func TestRemoveAll(t *testing.T) {
+	w1 := NewWordSet()
+	w1.Add(WeightedWord{Word: "a", Weight: 1})
+	w1.Add(WeightedWord{Word: "b", Weight: 3})
+	w1.Add(WeightedWord{Word: "c", Weight: 10})
+	w1.Add(WeightedWord{Word: "d", Weight: 15})
+
+	w2 := NewWordSet()
+	w2.Add(WeightedWord{Word: "a", Weight: 15})
+	w2.Add(WeightedWord{Word: "c", Weight: 4})
+	w2.Add(WeightedWord{Word: "e", Weight: 1})
+
+	w1.RemoveAll(w2)
+	if err := w1.Check(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	expected := NewWordSet()
+	expected.Add(WeightedWord{Word: "b", Weight: 3})
+	expected.Add(WeightedWord{Word: "d", Weight: 15})
+
+	if !wordSetsEqual(expected, w1) {
+		t.Error()
+	}
+}
+
+func TestDeserializeV1(t *testing.T) {
+	// The legacy format for the tree:
+	//   b
+	//  / \
+	// a   c
+	var buf bytes.Buffer
+	writeV1Node := func(word string, weight int64) {
+		binary.Write(&buf, binary.LittleEndian, int8(1))
+		binary.Write(&buf, binary.LittleEndian, weight)
+		binary.Write(&buf, binary.LittleEndian, int64(len(word)))
+		buf.WriteString(word)
+	}
+	writeV1Nil := func() {
+		binary.Write(&buf, binary.LittleEndian, int8(0))
+	}
+	writeV1Node("b", 2)
+	writeV1Node("a", 1)
+	writeV1Nil()
+	writeV1Nil()
+	writeV1Node("c", 3)
+	writeV1Nil()
+	writeV1Nil()
+
+	w, err := DeserializeWordSet(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	expected := NewWordSet()
+	expected.Add(WeightedWord{Word: "a", Weight: 1})
+	expected.Add(WeightedWord{Word: "b", Weight: 2})
+	expected.Add(WeightedWord{Word: "c", Weight: 3})
+	if !wordSetsEqual(expected, *w) {
+		t.Error("Wrong contents")
+	}
+
+	// Truncated input.
+	_, err = DeserializeWordSet(bytes.NewReader(buf.Bytes()[:buf.Len()-3]))
+	if err == nil {
+		t.Error("Expected error for truncated input")
+	}
+
+	// A degenerate, very deep tree.
+	buf.Reset()
+	for i := 0; i < 100000; i++ {
+		writeV1Node("x", 1)
+		writeV1Nil()
+	}
+	if _, err = DeserializeWordSet(&buf); err == nil {
+		t.Error("Expected error for deep input")
+	}
+
+	// A huge word length.
+	buf.Reset()
+	binary.Write(&buf, binary.LittleEndian, int8(1))
+	binary.Write(&buf, binary.LittleEndian, int64(1))
+	binary.Write(&buf, binary.LittleEndian, int64(1<<62))
+	if _, err = DeserializeWordSet(&buf); err == nil {
+		t.Error("Expected error for huge word length")
+	}
+}
+
+func TestDeserializeV2Corrupt(t *testing.T) {
+	w, _ := randomWordSet(100)
+	var buf bytes.Buffer
+	if err := w.Serialize(&buf); err != nil {
+		t.Error(err)
+		return
+	}
+	data := buf.Bytes()
+	if string(data[:4]) != "DKWS" {
+		t.Errorf("Bad magic: %q", data[:4])
+	}
+
+	for _, i := range []int{10, len(data) / 2, len(data) - 1} {
+		corrupt := append([]byte(nil), data...)
+		corrupt[i] ^= 0x40
+		if _, err := DeserializeWordSet(bytes.NewReader(corrupt)); err == nil {
+			t.Errorf("Expected error for corruption at byte %d", i)
+		}
+	}
+	for _, n := range []int{0, 3, 5, len(data) / 2, len(data) - 1} {
+		if _, err := DeserializeWordSet(bytes.NewReader(data[:n])); err == nil {
+			t.Errorf("Expected error for input truncated to %d bytes", n)
+		}
+	}
+
+	// The reader must be left just past the WordSet.
+	buf.WriteString("trailer")
+	if _, err := DeserializeWordSet(&buf); err != nil {
+		t.Error(err)
+	}
+	if buf.String() != "trailer" {
+		t.Errorf("Trailing data consumed: %q", buf.String())
+	}
+}
+
+func TestAttributes(t *testing.T) {
+	adjective := WordAttributes{PartOfSpeech: "j", Rank: 7, Dispersion: 0.5}
+	noun := WordAttributes{PartOfSpeech: "n", Rank: 3, Dispersion: 0.25}
+
+	w := NewWordSet()
+	w.Add(WeightedWord{Word: "red", Weight: 1})
+	w.Add(WeightedWord{Word: "red", Weight: 2, Attributes: adjective})
+	w.Add(WeightedWord{Word: "red", Weight: 4, Attributes: noun})
+	w.Add(WeightedWord{Word: "dog", Weight: 8, Attributes: noun})
+
+	red, _ := w.Lookup("red")
+	if red.Weight != 7 || red.Attributes != adjective {
+		t.Errorf("Wrong merged word: %v", red)
+	}
+
+	var buf bytes.Buffer
+	if err := w.Serialize(&buf); err != nil {
+		t.Error(err)
+		return
+	}
+	deserialized, err := DeserializeWordSet(&buf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !wordSetsEqual(w, *deserialized) {
+		t.Error("Attributes not serialized faithfully")
+	}
+
+	adjectives := w.Filter(func(word WeightedWord) bool {
+		return word.Attributes.PartOfSpeech == "j"
+	})
+	if adjectives.Size() != 1 {
+		t.Errorf("Size: expected %d, got %d", 1, adjectives.Size())
+	}
+	sample := adjectives.Sample(rand.New(rand.NewSource(1)), 1, 0)
+	if sample.GetWords()[0] != red {
+		t.Errorf("Sample lost attributes: %v", sample.GetWords()[0])
+	}
+
+	w.Add(WeightedWord{Word: "cat", Weight: 1,
+		Attributes: WordAttributes{Rank: -1}})
+	if err := w.Serialize(&bytes.Buffer{}); err == nil {
+		t.Error("Expected error for negative rank")
+	}
+}
+
+func TestCompositeKeys(t *testing.T) {
+	verb := WordAttributes{PartOfSpeech: "v"}
+	prep := WordAttributes{PartOfSpeech: "i"}
+	noun := WordAttributes{PartOfSpeech: "n"}
+
+	w := NewCompositeWordSet()
+	if !w.IsComposite() {
+		t.Error("Expected composite set")
+	}
+	w.Add(WeightedWord{Word: "like", Weight: 5, Attributes: verb})
+	w.Add(WeightedWord{Word: "like", Weight: 8, Attributes: prep})
+	w.Add(WeightedWord{Word: "like", Weight: 1, Attributes: verb})
+	w.Add(WeightedWord{Word: "lime", Weight: 2, Attributes: noun})
+	w.Add(WeightedWord{Word: "lick", Weight: 3, Attributes: verb})
+	w.Add(WeightedWord{Word: "lick", Weight: 4, Attributes: noun})
+	if err := w.Check(); err != nil {
+		t.Error(err)
+		return
+	}
+	if w.Size() != 5 {
+		t.Errorf("Size: expected %d, got %d", 5, w.Size())
+	}
+
+	like, ok := w.Lookup("like")
+	if !ok || like.Weight != 14 || like.Attributes != prep {
+		t.Errorf("Lookup: got %v, %v", like, ok)
+	}
+	likeVerb, ok := w.LookupPos("like", "v")
+	if !ok || likeVerb.Weight != 6 {
+		t.Errorf("LookupPos: got %v, %v", likeVerb, ok)
+	}
+	if _, ok = w.LookupPos("like", "n"); ok {
+		t.Error("LookupPos found missing entry")
+	}
+	if rank := w.Rank("like"); rank != 2 {
+		t.Errorf("Rank: expected %d, got %d", 2, rank)
+	}
+	if cw := w.CumulativeWeight("lime"); cw != 21 {
+		t.Errorf("CumulativeWeight: expected %d, got %d", 21, cw)
+	}
+	if prefix := w.Prefix("lik"); len(prefix) != 2 {
+		t.Errorf("Prefix: got %v", prefix)
+	}
+
+	var buf bytes.Buffer
+	if err := w.Serialize(&buf); err != nil {
+		t.Error(err)
+		return
+	}
+	deserialized, err := DeserializeWordSet(&buf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !deserialized.IsComposite() || !wordSetsEqual(w, *deserialized) {
+		t.Error("Composite set not serialized faithfully")
+	}
+
+	s, err := w.SampleDistinct(rand.New(rand.NewSource(5)), w.Size(), 0)
+	if err != nil || !wordSetsEqual(w, s) {
+		t.Errorf("SampleDistinct: got %v, %v", s.GetWords(), err)
+	}
+
+	aggregated := w.Aggregate()
+	expected := NewWordSet()
+	expected.Add(WeightedWord{Word: "lick", Weight: 7, Attributes: noun})
+	expected.Add(WeightedWord{Word: "like", Weight: 14, Attributes: prep})
+	expected.Add(WeightedWord{Word: "lime", Weight: 2, Attributes: noun})
+	if aggregated.IsComposite() || !wordSetsEqual(expected, aggregated) {
+		t.Errorf("Aggregate: got %v", aggregated.GetWords())
+	}
+
+	// Mixing key modes converts 'other' to the mode of 'self'.
+	if union := expected.Union(w, nil); union.Size() != 3 || union.Weight() != 46 {
+		t.Errorf("Union: got %v", union.GetWords())
+	}
+	if union := w.Union(expected, nil); union.Size() != 5 || union.Weight() != 46 {
+		t.Errorf("Union: got %v", union.GetWords())
+	}
+
+	if !w.Subtract(WeightedWord{Word: "like", Weight: 6, Attributes: verb}) {
+		t.Error("Wrong Subtract return value")
+	}
+	if _, ok = w.LookupPos("like", "i"); !ok {
+		t.Error("Subtract removed the wrong entry")
+	}
+	w.Add(WeightedWord{Word: "like", Weight: 1, Attributes: verb})
+	if !w.Remove("like") {
+		t.Error("Wrong Remove return value")
+	}
+	if _, ok = w.Lookup("like"); ok {
+		t.Error("Remove left an entry behind")
+	}
+	if err := w.Check(); err != nil {
+		t.Error(err)
+	}
+
+	built, err := NewCompositeWordSetFromSlice([]WeightedWord{
+		WeightedWord{Word: "like", Weight: 5, Attributes: verb},
+		WeightedWord{Word: "like", Weight: 8, Attributes: prep},
+		WeightedWord{Word: "like", Weight: 1, Attributes: verb},
+	})
+	if err != nil || built.Size() != 2 || built.Weight() != 14 {
+		t.Errorf("NewCompositeWordSetFromSlice: got %v, %v", built.GetWords(), err)
+	}
+}
+
+func TestOrderStatistics(t *testing.T) {
+	w := NewWordSet()
+	w.Add(WeightedWord{Word: "un", Weight: 1})
+	w.Add(WeightedWord{Word: "apple", Weight: 2})
+	w.Add(WeightedWord{Word: "undo", Weight: 4})
+	w.Add(WeightedWord{Word: "unzip", Weight: 8})
+	w.Add(WeightedWord{Word: "uncle", Weight: 16})
+	w.Add(WeightedWord{Word: "zebra", Weight: 32})
+	w.Add(WeightedWord{Word: "banana", Weight: 64})
+
+	if word, ok := w.Lookup("undo"); !ok || word.Weight != 4 {
+		t.Errorf("Lookup: got %v, %v", word, ok)
+	}
+	if _, ok := w.Lookup("unity"); ok {
+		t.Error("Lookup found missing word")
+	}
+
+	sorted := []string{"apple", "banana", "un", "uncle", "undo", "unzip", "zebra"}
+	var weight int64 = 0
+	for i, word := range sorted {
+		if rank := w.Rank(word); rank != int64(i) {
+			t.Errorf("Rank(%q): expected %d, got %d", word, i, rank)
+		}
+		if cw := w.CumulativeWeight(word); cw != weight {
+			t.Errorf("CumulativeWeight(%q): expected %d, got %d", word, weight, cw)
+		}
+		selected, ok := w.Select(int64(i))
+		if !ok || selected.Word != word {
+			t.Errorf("Select(%d): expected %q, got %v", i, word, selected)
+		}
+		weight += selected.Weight
+	}
+	if rank := w.Rank("cherry"); rank != 2 {
+		t.Errorf("Rank(%q): expected %d, got %d", "cherry", 2, rank)
+	}
+	if cw := w.CumulativeWeight("zzz"); cw != w.Weight() {
+		t.Errorf("CumulativeWeight(%q): expected %d, got %d", "zzz", w.Weight(), cw)
+	}
+	if _, ok := w.Select(7); ok {
+		t.Error("Select out of range succeeded")
+	}
+	if _, ok := w.Select(-1); ok {
+		t.Error("Select out of range succeeded")
+	}
+
+	checkWords := func(name string, actual []WeightedWord, expected ...string) {
+		if len(actual) != len(expected) {
+			t.Errorf("%s: expected %v, got %v", name, expected, actual)
+			return
+		}
+		for i := range actual {
+			if actual[i].Word != expected[i] {
+				t.Errorf("%s: expected %v, got %v", name, expected, actual)
+				return
+			}
+		}
+	}
+	checkWords("Range", w.Range("b", "unz"), "banana", "un", "uncle", "undo")
+	checkWords("Range", w.Range("z", "a"))
+	checkWords("Prefix", w.Prefix("un"), "un", "uncle", "undo", "unzip")
+	checkWords("Prefix", w.Prefix("und"), "undo")
+	checkWords("Prefix", w.Prefix("x"))
+	checkWords("Prefix", w.Prefix(""), sorted...)
+}
+
+func TestSetAlgebra(t *testing.T) {
+	w1 := NewWordSet()
+	w1.Add(WeightedWord{Word: "a", Weight: 1})
+	w1.Add(WeightedWord{Word: "b", Weight: 3})
+	w1.Add(WeightedWord{Word: "c", Weight: 10})
+	w1.Add(WeightedWord{Word: "d", Weight: 15})
+
+	w2 := NewWordSet()
+	w2.Add(WeightedWord{Word: "a", Weight: 15})
+	w2.Add(WeightedWord{Word: "b", Weight: 3})
+	w2.Add(WeightedWord{Word: "e", Weight: 1})
+	w2.Add(WeightedWord{Word: "f", Weight: 12})
+
+	union := w1.Union(w2, nil)
+	expected := NewWordSet()
+	expected.Add(WeightedWord{Word: "a", Weight: 16})
+	expected.Add(WeightedWord{Word: "b", Weight: 6})
+	expected.Add(WeightedWord{Word: "c", Weight: 10})
+	expected.Add(WeightedWord{Word: "d", Weight: 15})
+	expected.Add(WeightedWord{Word: "e", Weight: 1})
+	expected.Add(WeightedWord{Word: "f", Weight: 12})
+	if !wordSetsEqual(expected, union) {
+		t.Error("Union")
+	}
+
+	union = w1.Union(w2, func(a, b int64) int64 { return a - b })
+	expected = NewWordSet()
+	expected.Add(WeightedWord{Word: "c", Weight: 10})
+	expected.Add(WeightedWord{Word: "d", Weight: 15})
+	expected.Add(WeightedWord{Word: "e", Weight: 1})
+	expected.Add(WeightedWord{Word: "f", Weight: 12})
+	if !wordSetsEqual(expected, union) {
+		t.Error("Union with combine")
+	}
+
+	expected = NewWordSet()
+	expected.Add(WeightedWord{Word: "a", Weight: 1})
+	expected.Add(WeightedWord{Word: "b", Weight: 3})
+	if !wordSetsEqual(expected, w1.Intersect(w2)) {
+		t.Error("Intersect")
+	}
+
+	expected = NewWordSet()
+	expected.Add(WeightedWord{Word: "c", Weight: 10})
+	expected.Add(WeightedWord{Word: "d", Weight: 15})
+	if !wordSetsEqual(expected, w1.Difference(w2)) {
+		t.Error("Difference")
+	}
+
+	expected = NewWordSet()
+	expected.Add(WeightedWord{Word: "b", Weight: 1})
+	expected.Add(WeightedWord{Word: "c", Weight: 3})
+	expected.Add(WeightedWord{Word: "d", Weight: 5})
+	if !wordSetsEqual(expected, w1.Scale(0.3)) {
+		t.Error("Scale")
+	}
+
+	// The inputs must be untouched.
+	if w1.Size() != 4 || w1.Weight() != 29 || w2.Size() != 4 || w2.Weight() != 31 {
+		t.Error("Inputs were modified")
+	}
+
+	// Results share nodes with their inputs, but updates to one must not
+	// show up in the others.
+	union = w1.Union(w2, nil)
+	w1.Add(WeightedWord{Word: "a", Weight: 100})
+	w2.Remove("f")
+	union.Add(WeightedWord{Word: "c", Weight: 1000})
+	if w1.Size() != 4 || w1.Weight() != 129 || w2.Size() != 3 ||
+		w2.Weight() != 19 || union.Size() != 6 || union.Weight() != 1060 {
+		t.Error("Updates leaked between Union and its inputs")
+	}
+	if err := union.Check(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFuzzSetAlgebra(t *testing.T) {
+	rand.Seed(9238423)
+	for i := 0; i < 200; i++ {
+		a, aMap := randomWordSet(rand.Intn(200))
+		b, bMap := randomWordSet(rand.Intn(200))
+
+		union := NewWordSet()
+		intersect := NewWordSet()
+		difference := NewWordSet()
+		for word, weight := range aMap {
+			union.Add(WeightedWord{Word: word, Weight: weight})
+			if _, ok := bMap[word]; ok {
+				intersect.Add(WeightedWord{Word: word, Weight: weight})
+			} else {
+				difference.Add(WeightedWord{Word: word, Weight: weight})
+			}
+		}
+		for word, weight := range bMap {
+			union.Add(WeightedWord{Word: word, Weight: weight})
+		}
+
+		for _, c := range []struct {
+			name     string
+			expected WordSet
+			actual   WordSet
+		}{
+			{"Union", union, a.Union(b, nil)},
+			{"Intersect", intersect, a.Intersect(b)},
+			{"Difference", difference, a.Difference(b)},
+			{"Scale", a, a.Scale(1)},
+		} {
+			if err := c.actual.Check(); err != nil {
+				t.Errorf("%s: %v", c.name, err)
+				return
+			}
+			if !wordSetsEqual(c.expected, c.actual) {
+				t.Errorf("%s: wrong result", c.name)
+				return
+			}
+		}
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	rand.Seed(48372)
+	w, _ := randomWordSet(500)
+
+	snapshots := make([]WordSet, 0)
+	expected := make([][]WeightedWord, 0)
+	for i := 0; i < 50; i++ {
+		snapshots = append(snapshots, w.Snapshot())
+		expected = append(expected, w.GetWords())
+
+		for j := 0; j < 20; j++ {
+			word := WeightedWord{Word: randomString(3), Weight: 1 + rand.Int63n(10)}
+			switch rand.Intn(3) {
+			case 0:
+				w.Add(word)
+			case 1:
+				w.Subtract(word)
+			case 2:
+				w.Remove(word.Word)
+			}
+		}
+		if err := w.Check(); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	for i, snapshot := range snapshots {
+		if err := snapshot.Check(); err != nil {
+			t.Error(err)
+			return
+		}
+		words := snapshot.GetWords()
+		if len(words) != len(expected[i]) {
+			t.Errorf("Snapshot %d changed size", i)
+			continue
+		}
+		for j := range words {
+			if words[j] != expected[i][j] {
+				t.Errorf("Snapshot %d changed", i)
+				break
+			}
+		}
+	}
+
+	// Updating a snapshot must not affect the live set.
+	before := w.GetWords()
+	snapshot := w.Snapshot()
+	for _, word := range before {
+		snapshot.Remove(word.Word)
+	}
+	snapshot.Add(WeightedWord{Word: "zzzz", Weight: 1})
+	if snapshot.Size() != 1 {
+		t.Errorf("Size: expected %d, got %d", 1, snapshot.Size())
+	}
+	after := w.GetWords()
+	if len(after) != len(before) {
+		t.Error("Updating a snapshot affected the live set")
+		return
+	}
+	for i := range after {
+		if after[i] != before[i] {
+			t.Error("Updating a snapshot affected the live set")
+			return
+		}
+	}
+}
+
+func TestSnapshotConcurrent(t *testing.T) {
+	w, _ := randomWordSet(1000)
+	snapshots := make(chan WordSet)
+	done := make(chan bool)
+	for i := 0; i < 4; i++ {
+		go func(seed int64) {
+			r := rand.New(rand.NewSource(seed))
+			for snapshot := range snapshots {
+				if _, err := snapshot.SampleDistinct(r, 10, 0); err != nil {
+					t.Error(err)
+				}
+			}
+			done <- true
+		}(int64(i))
+	}
+
+	r := rand.New(rand.NewSource(8723))
+	for i := 0; i < 1000; i++ {
+		w.Add(WeightedWord{Word: fmt.Sprintf("word%d", r.Intn(2000)), Weight: 1})
+		w.Remove(fmt.Sprintf("word%d", r.Intn(2000)))
+		snapshots <- w.Snapshot()
+	}
+	close(snapshots)
+	for i := 0; i < 4; i++ {
+		<-done
+	}
+}
+
+func TestNewWordSetFromSorted(t *testing.T) {
+	for size := 0; size < 100; size++ {
+		words := make([]WeightedWord, size)
+		for i := range words {
+			words[i] = WeightedWord{Word: fmt.Sprintf("word%03d", i), Weight: int64(i + 1)}
+		}
+		w, err := NewWordSetFromSorted(words)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if err = w.Check(); err != nil {
+			t.Error(err)
+			return
+		}
+		if w.Size() != int64(size) {
+			t.Errorf("Size: expected %d, got %d", size, w.Size())
+		}
+	}
+
+	if _, err := NewWordSetFromSorted([]WeightedWord{
+		WeightedWord{Word: "b", Weight: 1}, WeightedWord{Word: "a", Weight: 1}}); err == nil {
+		t.Error("Expected error for unsorted input")
+	}
+	if _, err := NewWordSetFromSorted([]WeightedWord{
+		WeightedWord{Word: "a", Weight: 1}, WeightedWord{Word: "a", Weight: 1}}); err == nil {
+		t.Error("Expected error for duplicate input")
+	}
+	if _, err := NewWordSetFromSorted([]WeightedWord{
+		WeightedWord{Word: "a", Weight: 0}}); err == nil {
+		t.Error("Expected error for nonpositive weight")
+	}
+}
+
+func TestNewWordSetFromSlice(t *testing.T) {
+	rand.Seed(98234)
+	words := make([]WeightedWord, 5000)
+	expected := NewWordSet()
+	for i := range words {
+		words[i] = WeightedWord{Word: randomString(2), Weight: 1 + rand.Int63n(10)}
+		expected.Add(words[i])
+	}
+	first := words[0]
+
+	w, err := NewWordSetFromSlice(words)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if err = w.Check(); err != nil {
+		t.Error(err)
+		return
+	}
+	if !wordSetsEqual(expected, w) {
+		t.Error("Wrong contents")
+	}
+	if words[0] != first {
+		t.Error("Input slice was modified")
+	}
+
+	if _, err := NewWordSetFromSlice([]WeightedWord{
+		WeightedWord{Word: "a", Weight: 1}, WeightedWord{Word: "b", Weight: -1}}); err == nil {
+		t.Error("Expected error for nonpositive weight")
+	}
+}
+
 func TestSample(t *testing.T) {
 	w := NewWordSet()
-	w.Add(WeightedWord{"a", 1})
-	w.Add(WeightedWord{"d", 2})
-	w.Add(WeightedWord{"f", 4})
-	w.Add(WeightedWord{"b", 8})
-	w.Add(WeightedWord{"e", 16})
-	w.Add(WeightedWord{"c", 32})
+	w.Add(WeightedWord{Word: "a", Weight: 1})
+	w.Add(WeightedWord{Word: "d", Weight: 2})
+	w.Add(WeightedWord{Word: "f", Weight: 4})
+	w.Add(WeightedWord{Word: "b", Weight: 8})
+	w.Add(WeightedWord{Word: "e", Weight: 16})
+	w.Add(WeightedWord{Word: "c", Weight: 32})
 
-	s := w.Sample(6, 0)
+	r := rand.New(rand.NewSource(2837))
+	s := w.Sample(r, 6, 0)
 	if !wordSetsEqual(s, w) {
 		t.Error()
 	}
@@ -150,9 +855,9 @@ func TestSample(t *testing.T) {
 	for _, bias := range []int64{0, 10000} {
 		counts := make(map[string]int)
 		for i := 0; i < 10000; i++ {
-			s = w.Sample(2, bias)
+			s = w.Sample(r, 2, bias)
 			if s.Size() != 2 {
-				t.Error("Size: expected %d, got %d", 2, s.Size())
+				t.Errorf("Size: expected %d, got %d", 2, s.Size())
 				return
 			}
 			for _, word := range s.GetWords() {
@@ -178,11 +883,164 @@ func TestSample(t *testing.T) {
 		if counts["c"] > expectedCountC*2 {
 			t.Error("Count for \"c\" too large")
 		}
-		if counts["e"] < expectedCountE/2 {
-			t.Error("Count for \"e\" too small")
+		if counts["e"] < expectedCountE/2 {
+			t.Error("Count for \"e\" too small")
+		}
+		if counts["e"] > expectedCountE*2 {
+			t.Error("Count for \"e\" too large")
+		}
+	}
+}
+
+func TestSampleDistinct(t *testing.T) {
+	// One word holds nearly all of the weight, which would make a
+	// retry-based sampler loop for a long time.
+	w := NewWordSet()
+	w.Add(WeightedWord{Word: "heavy", Weight: 1 << 60})
+	for i := 0; i < 100; i++ {
+		w.Add(WeightedWord{Word: randomString(8), Weight: 1})
+	}
+
+	r := rand.New(rand.NewSource(374))
+	s, err := w.SampleDistinct(r, w.Size(), 0)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !wordSetsEqual(s, w) {
+		t.Error("Sampling every word did not return the whole set")
+	}
+
+	if _, err = w.SampleDistinct(r, w.Size()+1, 0); err == nil {
+		t.Error("Expected error when sampling too many words")
+	}
+	if _, err = w.SampleDistinct(r, 1, -1); err == nil {
+		t.Error("Expected error for negative nodeBias")
+	}
+	if s, err = NewWordSet().SampleDistinct(r, 0, 0); err != nil || s.Size() != 0 {
+		t.Error("Sampling zero words from an empty set failed")
+	}
+}
+
+func TestWeightTransforms(t *testing.T) {
+	w := NewWordSet()
+	w.Add(WeightedWord{Word: "a", Weight: 1})
+	w.Add(WeightedWord{Word: "b", Weight: 4})
+	w.Add(WeightedWord{Word: "c", Weight: 4})
+	w.Add(WeightedWord{Word: "d", Weight: 100})
+	byRank := RankTransform(w, func(rank int64) float64 {
+		return float64(rank)
+	})
+
+	for _, c := range []struct {
+		name      string
+		transform WeightTransform
+		word      WeightedWord
+		expected  float64
+	}{
+		{"Power", Power(0.5), WeightedWord{Word: "b", Weight: 4}, 2},
+		{"Temperature", Temperature(2), WeightedWord{Word: "b", Weight: 4}, 2},
+		{"Log", Log(), WeightedWord{Word: "a", Weight: 1}, math.Log(2)},
+		{"InverseFrequency", InverseFrequency(), WeightedWord{Word: "b", Weight: 4}, 0.25},
+		{"RankTransform", byRank, WeightedWord{Word: "b", Weight: 4}, 1},
+		{"RankTransform", byRank, WeightedWord{Word: "a", Weight: 1}, 3},
+	} {
+		if actual := c.transform(c.word); math.Abs(actual-c.expected) > 1e-9 {
+			t.Errorf("%s(%v): expected %v, got %v", c.name, c.word, c.expected, actual)
+		}
+	}
+}
+
+func TestSampleTransformed(t *testing.T) {
+	w := NewWordSet()
+	w.Add(WeightedWord{Word: "a", Weight: 1})
+	w.Add(WeightedWord{Word: "b", Weight: 1000})
+	w.Add(WeightedWord{Word: "c", Weight: 1000000})
+
+	r := rand.New(rand.NewSource(4721))
+	s, err := w.SampleTransformed(r, 3, InverseFrequency())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !wordSetsEqual(s, w) {
+		t.Error("Sampling every word did not return the whole set")
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		s, err = w.SampleTransformed(r, 1, InverseFrequency())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		counts[s.GetWords()[0].Word]++
+	}
+	if counts["a"] < 950 {
+		t.Errorf("InverseFrequency did not favor rare words: %v", counts)
+	}
+
+	// Only words of rank 1 are drawable.
+	band := RankTransform(w, func(rank int64) float64 {
+		if rank == 1 {
+			return 1
+		}
+		return 0
+	})
+	s, err = w.SampleTransformed(r, 1, band)
+	if err != nil || s.GetWords()[0].Word != "b" {
+		t.Errorf("Rank band: got %v, %v", s.GetWords(), err)
+	}
+	if _, err = w.SampleTransformed(r, 2, band); err == nil {
+		t.Error("Expected error when too few words have positive weight")
+	}
+	if _, err = w.SampleTransformed(r, 1, func(WeightedWord) float64 {
+		return -1
+	}); err == nil {
+		t.Error("Expected error for negative transformed weight")
+	}
+}
+
+func TestTransformedIndex(t *testing.T) {
+	w, _ := randomWordSet(1000)
+	original := w.Snapshot()
+	index, err := NewTransformedIndex(w, Power(0.5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The index is unaffected by later updates to the set.
+	w.Add(WeightedWord{Word: "extra", Weight: 1})
+	if index.Size() != original.Size() {
+		t.Errorf("Expected size %d, got %d", original.Size(), index.Size())
+	}
+
+	for seed := int64(0); seed < 5; seed++ {
+		// Sampling does not use up the index.
+		s, err := index.Sample(rand.New(rand.NewSource(seed)), index.Size())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !wordSetsEqual(s, original) {
+			t.Error("Sampling every word did not return the original set")
 		}
-		if counts["e"] > expectedCountE*2 {
-			t.Error("Count for \"e\" too large")
+
+		// The index draws exactly as SampleTransformed does.
+		a, _ := index.Sample(rand.New(rand.NewSource(seed)), 20)
+		b, _ := original.SampleTransformed(rand.New(rand.NewSource(seed)), 20,
+			Power(0.5))
+		if !wordSetsEqual(a, b) {
+			t.Errorf("Seed %d: index and SampleTransformed disagree", seed)
+		}
+	}
+}
+
+func TestSampleDeterministic(t *testing.T) {
+	w, _ := randomWordSet(1000)
+	for seed := int64(0); seed < 10; seed++ {
+		a := w.Sample(rand.New(rand.NewSource(seed)), 20, 1)
+		b := w.Sample(rand.New(rand.NewSource(seed)), 20, 1)
+		if !wordSetsEqual(a, b) {
+			t.Errorf("Different samples for seed %d", seed)
 		}
 	}
 }
@@ -191,15 +1049,15 @@ func TestPrettyPrint(t *testing.T) {
 	w := NewWordSet()
 	for _, word := range strings.Split(
 		"the quick brown fox", " ") {
-		w.Add(WeightedWord{word, 1})
+		w.Add(WeightedWord{Word: word, Weight: 1})
 	}
 
 	actual := strings.TrimSpace(w.PrettyPrint())
 	expected := strings.TrimSpace(`
-+-- quick
-  +-L brown
-  | +-R fox
-  +-R the`)
++-- quick (1)
+  +-L brown (1)
+  | +-R fox (1)
+  +-R the (1)`)
 
 	if actual != expected {
 		t.Errorf("Actual:\n%s\nExpected:\n%s", actual, expected)
@@ -210,7 +1068,7 @@ func TestFuzz(t *testing.T) {
   rand.Seed(7834763)
   w := NewWordSet()
   for i := 0; i < 10000; i++ {
-    w.Add(WeightedWord{randomString(32), 1})
+    w.Add(WeightedWord{Word: randomString(32), Weight: 1})
     if err := w.Check(); err != nil {
       t.Error(err)
       return
@@ -218,6 +1076,750 @@ func TestFuzz(t *testing.T) {
   }
 }
 
+func TestFuzzRemove(t *testing.T) {
+	rand.Seed(2384729)
+	w := NewWordSet()
+	present := make(map[string]bool)
+	for i := 0; i < 10000; i++ {
+		word := randomString(2)
+		if rand.Intn(3) == 0 {
+			if w.Remove(word) != present[word] {
+				t.Errorf("Wrong Remove return value for %q", word)
+				return
+			}
+			delete(present, word)
+		} else {
+			w.Add(WeightedWord{Word: word, Weight: 1})
+			present[word] = true
+		}
+		if err := w.Check(); err != nil {
+			t.Error(err)
+			return
+		}
+		if w.Size() != int64(len(present)) {
+			t.Errorf("Size: expected %d, got %d", len(present), w.Size())
+			return
+		}
+	}
+}
+
+func TestTextFormats(t *testing.T) {
+	w := NewCompositeWordSet()
+	w.Add(WeightedWord{"lead", 5, WordAttributes{"n", 10, 0.5}})
+	w.Add(WeightedWord{"lead", 7, WordAttributes{"v", 8, 0.25}})
+	w.Add(WeightedWord{"say \"hi\", now", 2, WordAttributes{}})
+
+	var buf bytes.Buffer
+	if err := w.WriteCSV(&buf, NewCSVFormat()); err != nil {
+		t.Fatal(err)
+	}
+	expected := "word,weight,pos,rank,dispersion\n" +
+		"lead,5,n,10,0.5\n" +
+		"lead,7,v,8,0.25\n" +
+		"\"say \"\"hi\"\", now\",2,,,\n"
+	if buf.String() != expected {
+		t.Errorf("Expected CSV:\n%s\nGot:\n%s", expected, buf.String())
+	}
+	read, err := ReadCSV(&buf, NewCSVFormat(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !wordSetsEqual(w, read) {
+		t.Errorf("CSV round trip: expected %v, got %v",
+			w.GetWords(), read.GetWords())
+	}
+
+	text, err := w.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	read = NewCompositeWordSet()
+	if err := read.UnmarshalText(text); err != nil {
+		t.Fatal(err)
+	}
+	if !wordSetsEqual(w, read) {
+		t.Errorf("TSV round trip: expected %v, got %v",
+			w.GetWords(), read.GetWords())
+	}
+
+	data, err := json.Marshal(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fromJson WordSet
+	if err := json.Unmarshal(data, &fromJson); err != nil {
+		t.Fatal(err)
+	}
+	if !fromJson.IsComposite() || !wordSetsEqual(w, fromJson) {
+		t.Errorf("JSON round trip: expected %v, got %v",
+			w.GetWords(), fromJson.GetWords())
+	}
+}
+
+func TestReadCSVColumns(t *testing.T) {
+	format := CSVFormat{';', 0, 2, 0, -1, -1, -1, nil}
+	read, err := ReadCSV(strings.NewReader("3;x;apple\n4;y;banana\n1;z;apple\n"),
+		format, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []WeightedWord{
+		WeightedWord{Word: "apple", Weight: 4},
+		WeightedWord{Word: "banana", Weight: 4},
+	}
+	words := read.GetWords()
+	if fmt.Sprint(words) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v, got %v", expected, words)
+	}
+
+	if _, err := ReadCSV(strings.NewReader("apple;x\n"), format,
+		false); err == nil {
+		t.Error("Expected an error for a missing column")
+	}
+	if _, err := ReadCSV(strings.NewReader("x;y;apple\n"), format,
+		false); err == nil {
+		t.Error("Expected an error for a bad weight")
+	}
+
+	format.Filter = func(record []string) bool { return record[1] != "y" }
+	read, err = ReadCSV(strings.NewReader("3;x;apple\n4;y;banana\n"), format,
+		false)
+	if err != nil || read.Size() != 1 || read.Weight() != 3 {
+		t.Errorf("Filter: got %v, %v", read.GetWords(), err)
+	}
+
+	format = NewCSVFormat()
+	format.HeaderLines = 0
+	if _, err := ReadCSV(strings.NewReader("apple,1,n,-2,0\n"), format,
+		false); err == nil {
+		t.Error("Expected an error for a negative rank")
+	}
+	format.PosColumn = format.WordColumn
+	if _, err := ReadCSV(strings.NewReader("apple,1\n"), format,
+		false); err == nil {
+		t.Error("Expected an error for a repeated column")
+	}
+}
+
+func TestFreeze(t *testing.T) {
+	w := NewWordSet()
+	w.Add(WeightedWord{Word: "a", Weight: 1})
+	w.Add(WeightedWord{Word: "b", Weight: 2})
+	w.Add(WeightedWord{Word: "c", Weight: 7})
+
+	if _, err := w.Freeze(-1); err == nil {
+		t.Error("Expected an error for a negative nodeBias")
+	}
+
+	for _, bias := range []int64{0, 5} {
+		f, err := w.Freeze(bias)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Size() != 3 || f.Weight() != 10+3*bias {
+			t.Errorf("Wrong size or weight: %d, %d", f.Size(), f.Weight())
+		}
+
+		r := rand.New(rand.NewSource(1))
+		const draws = 100000
+		counts := make(map[string]int)
+		for i := 0; i < draws; i++ {
+			word, ok := f.Draw(r)
+			if !ok {
+				t.Fatal("Draw failed")
+			}
+			counts[word.Word]++
+		}
+		for _, word := range w.GetWords() {
+			expected := float64(draws) * float64(word.Weight+bias) /
+				float64(f.Weight())
+			if math.Abs(float64(counts[word.Word])-expected) >
+				5*math.Sqrt(expected)+1 {
+				t.Errorf("Bias %d: expected about %.0f draws of %q, got %d",
+					bias, expected, word.Word, counts[word.Word])
+			}
+		}
+	}
+
+	f, _ := w.Freeze(0)
+	r := rand.New(rand.NewSource(2))
+	for i := 0; i < 100; i++ {
+		sample, err := f.Sample(r, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sample.Size() != 2 {
+			t.Errorf("Bad sample: %v", sample.GetWords())
+		}
+	}
+	if sample, err := f.Sample(r, 3); err != nil || sample.Size() != 3 {
+		t.Errorf("Failed to sample every word: %v", err)
+	}
+	if _, err := f.Sample(r, 4); err == nil {
+		t.Error("Expected an error for an oversized sample")
+	}
+
+	empty, err := NewWordSet().Freeze(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := empty.Draw(r); ok {
+		t.Error("Expected Draw to fail on an empty table")
+	}
+}
+
+func TestFreezeComposite(t *testing.T) {
+	w := NewCompositeWordSet()
+	w.Add(WeightedWord{Word: "run", Weight: 3,
+		Attributes: WordAttributes{PartOfSpeech: "n"}})
+	w.Add(WeightedWord{Word: "run", Weight: 5,
+		Attributes: WordAttributes{PartOfSpeech: "v"}})
+	w.Add(WeightedWord{Word: "walk", Weight: 2,
+		Attributes: WordAttributes{PartOfSpeech: "v"}})
+
+	f, err := w.Freeze(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sample, err := f.Sample(rand.New(rand.NewSource(1)), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sample.IsComposite() || !wordSetsEqual(sample, w) {
+		t.Errorf("Expected every homograph, got %v", sample.GetWords())
+	}
+}
+
+func TestFreezeSampleDistribution(t *testing.T) {
+	w, _ := randomWordSet(20)
+	f, err := w.Freeze(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Compare how often each word appears in samples of 5 from the frozen
+	// table and from the tree.
+	const trials = 20000
+	frozenCounts := make(map[string]int)
+	treeCounts := make(map[string]int)
+	r := rand.New(rand.NewSource(3))
+	for i := 0; i < trials; i++ {
+		frozen, err := f.Sample(r, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree, err := w.SampleDistinct(r, 5, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, word := range frozen.GetWords() {
+			frozenCounts[word.Word]++
+		}
+		for _, word := range tree.GetWords() {
+			treeCounts[word.Word]++
+		}
+	}
+	for _, word := range w.GetWords() {
+		a := float64(frozenCounts[word.Word])
+		b := float64(treeCounts[word.Word])
+		if math.Abs(a-b) > 5*math.Sqrt(a+b)+1 {
+			t.Errorf("%q drawn %v times from the table but %v from the tree",
+				word.Word, a, b)
+		}
+	}
+}
+
+func TestIterators(t *testing.T) {
+	for _, size := range []int{0, 1, 2, 10, 200} {
+		w, _ := randomWordSet(size)
+		alphabetical := w.Range("", "\xff")
+
+		words := make([]WeightedWord, 0)
+		w.Each(func(word WeightedWord) bool {
+			words = append(words, word)
+			return true
+		})
+		if fmt.Sprint(words) != fmt.Sprint(alphabetical) {
+			t.Errorf("Each: expected %v, got %v", alphabetical, words)
+		}
+
+		words = words[:0]
+		it := w.Iterator()
+		for word, ok := it.Next(); ok; word, ok = it.Next() {
+			words = append(words, word)
+		}
+		if fmt.Sprint(words) != fmt.Sprint(alphabetical) {
+			t.Errorf("Iterator: expected %v, got %v", alphabetical, words)
+		}
+
+		words = words[:0]
+		byWeight := w.ByWeight()
+		for word, ok := byWeight.Next(); ok; word, ok = byWeight.Next() {
+			words = append(words, word)
+		}
+		if expected := w.GetWords(); fmt.Sprint(words) != fmt.Sprint(expected) {
+			t.Errorf("ByWeight: expected %v, got %v", expected, words)
+		}
+
+		for i := 0; i < 10; i++ {
+			start := randomString(3)
+			words = words[:0]
+			it := w.IteratorFrom(start)
+			for word, ok := it.Next(); ok; word, ok = it.Next() {
+				words = append(words, word)
+			}
+			expected := w.Range(start, "\xff")
+			if fmt.Sprint(words) != fmt.Sprint(expected) {
+				t.Errorf("IteratorFrom(%q): expected %v, got %v",
+					start, expected, words)
+			}
+		}
+	}
+
+	w := NewWordSet()
+	for _, word := range []string{"a", "b", "c"} {
+		w.Add(WeightedWord{Word: word, Weight: 1})
+	}
+	visited := 0
+	w.Each(func(word WeightedWord) bool {
+		visited++
+		return word.Word != "b"
+	})
+	if visited != 2 {
+		t.Errorf("Each should stop after 2 words, but visited %d", visited)
+	}
+}
+
+func TestWeightIndex(t *testing.T) {
+	w, _ := randomWordSet(300)
+	index := w.IndexByWeight()
+	all := w.GetWords()
+	if index.Size() != int64(len(all)) {
+		t.Fatalf("Expected size %d, got %d", len(all), index.Size())
+	}
+
+	for _, k := range []int64{0, 1, 10, index.Size(), index.Size() + 5} {
+		expected := all
+		if k < index.Size() {
+			expected = all[:k]
+		}
+		if got := w.TopK(k); fmt.Sprint(got) != fmt.Sprint(expected) {
+			t.Errorf("WordSet.TopK(%d): expected %v, got %v", k, expected, got)
+		}
+		if got := index.TopK(k); fmt.Sprint(got) != fmt.Sprint(expected) {
+			t.Errorf("WeightIndex.TopK(%d): expected %v, got %v",
+				k, expected, got)
+		}
+	}
+
+	if got := index.ByRankRange(10, 20); fmt.Sprint(got) !=
+		fmt.Sprint(all[10:20]) {
+		t.Errorf("ByRankRange: expected %v, got %v", all[10:20], got)
+	}
+	if got := index.ByRankRange(-5, 3); fmt.Sprint(got) !=
+		fmt.Sprint(all[:3]) {
+		t.Errorf("ByRankRange: expected %v, got %v", all[:3], got)
+	}
+	for _, bounds := range [][2]int64{{5, 2}, {-3, -1}, {1000, 2000}} {
+		if got := index.ByRankRange(bounds[0], bounds[1]); len(got) != 0 {
+			t.Errorf("ByRankRange(%v): expected nothing, got %v", bounds, got)
+		}
+	}
+
+	band := index.Band(10, 20)
+	if err := band.Check(); err != nil {
+		t.Error(err)
+	}
+	if fmt.Sprint(band.GetWords()) != fmt.Sprint(all[10:20]) {
+		t.Errorf("Band: expected %v, got %v", all[10:20], band.GetWords())
+	}
+
+	rank := index.RankOfWeight(all[10].Weight)
+	if rank > 10 || all[rank].Weight != all[10].Weight ||
+		(rank > 0 && all[rank-1].Weight <= all[10].Weight) {
+		t.Errorf("Bad RankOfWeight: %d", rank)
+	}
+
+	q := NewWordSet()
+	for i := 1; i <= 4; i++ {
+		q.Add(WeightedWord{Word: fmt.Sprint(i), Weight: int64(i * 10)})
+	}
+	qIndex := q.IndexByWeight()
+	for _, c := range []struct {
+		q        float64
+		expected int64
+	}{{0, 10}, {0.25, 10}, {0.3, 20}, {0.5, 20}, {0.75, 30}, {1, 40}} {
+		if got, ok := qIndex.WeightQuantile(c.q); !ok || got != c.expected {
+			t.Errorf("WeightQuantile(%v): expected %d, got %d", c.q, c.expected,
+				got)
+		}
+	}
+	if _, ok := qIndex.WeightQuantile(1.5); ok {
+		t.Error("Expected WeightQuantile to reject q > 1")
+	}
+	if _, ok := NewWordSet().IndexByWeight().WeightQuantile(0.5); ok {
+		t.Error("Expected WeightQuantile to fail on an empty index")
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	for _, c := range []struct {
+		a, b     string
+		expected int
+	}{
+		{"", "", 0},
+		{"", "abc", 3},
+		{"kitten", "sitting", 3},
+		{"flaw", "lawn", 2},
+		{"café", "cafe", 1},
+		{"same", "same", 0},
+	} {
+		if got := EditDistance(c.a, c.b); got != c.expected {
+			t.Errorf("EditDistance(%q, %q): expected %d, got %d",
+				c.a, c.b, c.expected, got)
+		}
+		if got := EditDistance(c.b, c.a); got != c.expected {
+			t.Errorf("EditDistance(%q, %q): expected %d, got %d",
+				c.b, c.a, c.expected, got)
+		}
+	}
+}
+
+func TestFuzzyIndex(t *testing.T) {
+	w, _ := randomWordSet(500)
+	index := NewFuzzyIndex(w)
+	if index.Size() != w.Size() {
+		t.Errorf("Expected size %d, got %d", w.Size(), index.Size())
+	}
+
+	for i := 0; i < 100; i++ {
+		query := randomString(4)
+		maxDistance := rand.Intn(3)
+
+		// Compare against a linear scan.
+		expected := make([]FuzzyMatch, 0)
+		for _, word := range w.GetWords() {
+			if d := EditDistance(query, word.Word); d <= maxDistance {
+				expected = append(expected, FuzzyMatch{word, d})
+			}
+		}
+		for j := 1; j < len(expected); j++ {
+			for k := j; k > 0 && expected[k].Distance < expected[k-1].Distance; k-- {
+				expected[k], expected[k-1] = expected[k-1], expected[k]
+			}
+		}
+
+		got := index.Lookup(query, maxDistance)
+		if fmt.Sprint(got) != fmt.Sprint(expected) {
+			t.Errorf("Lookup(%q, %d): expected %v, got %v",
+				query, maxDistance, expected, got)
+		}
+	}
+
+	c := NewCompositeWordSet()
+	c.Add(WeightedWord{"lead", 5, WordAttributes{PartOfSpeech: "n"}})
+	c.Add(WeightedWord{"lead", 7, WordAttributes{PartOfSpeech: "v"}})
+	c.Add(WeightedWord{"load", 20, WordAttributes{PartOfSpeech: "v"}})
+	c.Add(WeightedWord{"lean", 3, WordAttributes{PartOfSpeech: "j"}})
+	matches := NewFuzzyIndex(c).Lookup("lea", 1)
+	if len(matches) != 2 || matches[0].Word.Word != "lead" ||
+		matches[0].Word.Weight != 12 || matches[1].Word.Word != "lean" {
+		t.Errorf("Bad matches: %v", matches)
+	}
+}
+
+func TestFlatWordSet(t *testing.T) {
+	plain, _ := randomWordSet(300)
+	composite := NewCompositeWordSet()
+	for _, word := range plain.GetWords() {
+		for _, pos := range []string{"n", "v"} {
+			if rand.Intn(2) == 0 {
+				composite.Add(WeightedWord{word.Word, word.Weight,
+					WordAttributes{pos, rand.Int63n(100), rand.Float64()}})
+			}
+		}
+	}
+
+	for _, w := range []WordSet{NewWordSet(), plain, composite} {
+		var buf bytes.Buffer
+		if err := w.WriteFlat(&buf); err != nil {
+			t.Fatal(err)
+		}
+		f, err := NewFlatWordSet(buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Check(); err != nil {
+			t.Error(err)
+		}
+
+		var tree, flat ReadOnlyWordSet = w, f
+		if flat.IsComposite() != tree.IsComposite() ||
+			flat.Size() != tree.Size() || flat.Weight() != tree.Weight() {
+			t.Errorf("Wrong mode, size or weight")
+		}
+		if fmt.Sprint(flat.GetWords()) != fmt.Sprint(tree.GetWords()) {
+			t.Errorf("GetWords: expected %v, got %v",
+				tree.GetWords(), flat.GetWords())
+		}
+		for i := int64(-1); i <= tree.Size(); i++ {
+			a, aOk := tree.Select(i)
+			b, bOk := flat.Select(i)
+			if a != b || aOk != bOk {
+				t.Errorf("Select(%d): expected %v, got %v", i, a, b)
+			}
+		}
+		for i := 0; i < 50; i++ {
+			word := randomString(3)
+			a, aOk := tree.Lookup(word)
+			b, bOk := flat.Lookup(word)
+			if a != b || aOk != bOk {
+				t.Errorf("Lookup(%q): expected %v, got %v", word, a, b)
+			}
+			a, aOk = tree.LookupPos(word, "v")
+			b, bOk = flat.LookupPos(word, "v")
+			if a != b || aOk != bOk {
+				t.Errorf("LookupPos(%q): expected %v, got %v", word, a, b)
+			}
+			if tree.Rank(word) != flat.Rank(word) ||
+				tree.CumulativeWeight(word) != flat.CumulativeWeight(word) {
+				t.Errorf("Wrong Rank or CumulativeWeight for %q", word)
+			}
+			hi := randomString(3)
+			if fmt.Sprint(tree.Range(word, hi)) != fmt.Sprint(flat.Range(word, hi)) {
+				t.Errorf("Range(%q, %q) differs", word, hi)
+			}
+			prefix := word[:1]
+			if fmt.Sprint(tree.Prefix(prefix)) != fmt.Sprint(flat.Prefix(prefix)) {
+				t.Errorf("Prefix(%q) differs", prefix)
+			}
+		}
+
+		count := 0
+		flat.Each(func(word WeightedWord) bool {
+			count++
+			return count < 3
+		})
+		expected := 3
+		if tree.Size() < 3 {
+			expected = int(tree.Size())
+		}
+		if count != expected {
+			t.Errorf("Each: expected %d words, visited %d", expected, count)
+		}
+
+		r := rand.New(rand.NewSource(5))
+		sample, err := flat.SampleDistinct(r, tree.Size()/2, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sample.Check(); err != nil {
+			t.Error(err)
+		}
+		if sample.Size() != tree.Size()/2 ||
+			sample.IsComposite() != tree.IsComposite() {
+			t.Errorf("Bad sample: %v", sample.GetWords())
+		}
+		for _, word := range sample.GetWords() {
+			if entry, ok := tree.LookupPos(word.Word,
+				word.Attributes.PartOfSpeech); !ok || entry != word {
+				t.Errorf("Sampled a word not in the set: %v", word)
+			}
+		}
+		if _, err := flat.SampleDistinct(r, tree.Size()+1, 0); err == nil {
+			t.Error("Expected an error for an oversized sample")
+		}
+	}
+}
+
+func TestFlatWordSetSampleDistribution(t *testing.T) {
+	w := NewWordSet()
+	for i, weight := range []int64{1, 2, 3, 10, 30} {
+		w.Add(WeightedWord{Word: fmt.Sprint(i), Weight: weight})
+	}
+	var buf bytes.Buffer
+	if err := w.WriteFlat(&buf); err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewFlatWordSet(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const trials = 20000
+	flatCounts := make(map[string]int)
+	treeCounts := make(map[string]int)
+	r := rand.New(rand.NewSource(6))
+	for i := 0; i < trials; i++ {
+		flat, _ := f.SampleDistinct(r, 3, 2)
+		tree, _ := w.SampleDistinct(r, 3, 2)
+		for _, word := range flat.GetWords() {
+			flatCounts[word.Word]++
+		}
+		for _, word := range tree.GetWords() {
+			treeCounts[word.Word]++
+		}
+	}
+	for _, word := range w.GetWords() {
+		a := float64(flatCounts[word.Word])
+		b := float64(treeCounts[word.Word])
+		if math.Abs(a-b) > 5*math.Sqrt(a+b)+1 {
+			t.Errorf("%q drawn %v times from the flat set but %v from the tree",
+				word.Word, a, b)
+		}
+	}
+}
+
+func TestFlatWordSetCorrupt(t *testing.T) {
+	w, _ := randomWordSet(50)
+	var buf bytes.Buffer
+	if err := w.WriteFlat(&buf); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	for n := 0; n < len(data); n += 7 {
+		if _, err := NewFlatWordSet(data[:n]); err == nil {
+			t.Errorf("Expected an error for %d of %d bytes", n, len(data))
+		}
+	}
+	for i := 0; i < 200; i++ {
+		corrupt := append([]byte(nil), data...)
+		corrupt[rand.Intn(len(corrupt))] ^= byte(1 + rand.Intn(255))
+		// Entries are only validated by Check, and corruption may go unnoticed
+		// even then (in an attribute, say), but queries on whatever is
+		// accepted must not crash.
+		if f, err := NewFlatWordSet(corrupt); err == nil {
+			f.Check()
+			f.GetWords()
+			f.Prefix("a")
+			f.Lookup("b")
+			f.SampleDistinct(rand.New(rand.NewSource(int64(i))), 10, 1)
+		}
+	}
+
+	// A bad weight in the first entry is only caught by Check.
+	corrupt := append([]byte(nil), data...)
+	corrupt[32+8] ^= 0x80
+	f, err := NewFlatWordSet(corrupt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Check(); err == nil {
+		t.Error("Expected Check to catch a bad weight")
+	}
+}
+
+func TestMapFlatWordSet(t *testing.T) {
+	w, _ := randomWordSet(100)
+	file, err := ioutil.TempFile("", "flat_word_set")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	if err := w.WriteFlat(file); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	f, err := MapFlatWordSet(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(f.GetWords()) != fmt.Sprint(w.GetWords()) {
+		t.Errorf("Expected %v, got %v", w.GetWords(), f.GetWords())
+	}
+	if err := f.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBuildWordSetContext(t *testing.T) {
+	var running, maxRunning int32
+	tasks := make([]WordSetTask, 20)
+	expected := NewWordSet()
+	for i := range tasks {
+		w, _ := randomWordSet(50)
+		expected.AddAll(w)
+		tasks[i] = WordSetTask{
+			Name: fmt.Sprintf("task%d", i),
+			Run: func(ctx context.Context) (WordSet, error) {
+				n := atomic.AddInt32(&running, 1)
+				for {
+					m := atomic.LoadInt32(&maxRunning)
+					if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+						break
+					}
+				}
+				atomic.AddInt32(&running, -1)
+				return w, nil
+			},
+		}
+	}
+
+	calls := 0
+	w, err := BuildWordSetContext(context.Background(), tasks, 3,
+		func(name string, done, total int) {
+			calls++
+			if done != calls || total != len(tasks) {
+				t.Errorf("Wrong progress: %d/%d", done, total)
+			}
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Check(); err != nil {
+		t.Error(err)
+	}
+	if !wordSetsEqual(w, expected) {
+		t.Errorf("Expected %v, got %v", expected.GetWords(), w.GetWords())
+	}
+	if calls != len(tasks) {
+		t.Errorf("Expected %d progress calls, got %d", len(tasks), calls)
+	}
+	if maxRunning > 3 {
+		t.Errorf("Ran %d tasks at once", maxRunning)
+	}
+
+	// No tasks.
+	w, err = BuildWordSetContext(context.Background(), nil, 0, nil)
+	if err != nil || w.Size() != 0 {
+		t.Errorf("Expected empty set, got %v, %v", w.GetWords(), err)
+	}
+
+	// A failing task cancels the others and is named in the error.
+	boom := errors.New("boom")
+	tasks[7].Run = func(ctx context.Context) (WordSet, error) {
+		return NewWordSet(), boom
+	}
+	var started int32
+	for i := 8; i < len(tasks); i++ {
+		tasks[i].Run = func(ctx context.Context) (WordSet, error) {
+			atomic.AddInt32(&started, 1)
+			<-ctx.Done()
+			return NewWordSet(), ctx.Err()
+		}
+	}
+	_, err = BuildWordSetContext(context.Background(), tasks, 3, nil)
+	if err == nil || err.Error() != `Task "task7" failed: boom` {
+		t.Errorf("Wrong error: %v", err)
+	}
+	if !errors.Is(err, boom) {
+		t.Errorf("Task error not wrapped: %v", err)
+	}
+	if started > 2 {
+		t.Errorf("Started %d tasks after the failure", started)
+	}
+
+	// A cancelled context stops the build.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = BuildWordSetContext(ctx, tasks, 3, nil)
+	if err != context.Canceled {
+		t.Errorf("Expected context.Canceled; got %v", err)
+	}
+}
+
 // Helpers.
 
 const alpha string = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
@@ -231,6 +1833,17 @@ func randomString(maxLength int32) string {
   return string(str)
 }
 
+func randomWordSet(size int) (WordSet, map[string]int64) {
+	w := NewWordSet()
+	m := make(map[string]int64)
+	for i := 0; i < size; i++ {
+		word := WeightedWord{Word: randomString(3), Weight: 1 + rand.Int63n(10)}
+		w.Add(word)
+		m[word.Word] += word.Weight
+	}
+	return w, m
+}
+
 func wordSetsEqual(a, b WordSet) bool {
 	aWords := a.GetWords()
 	bWords := b.GetWords()
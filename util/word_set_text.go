@@ -0,0 +1,293 @@
+// Text formats for WordSets: JSON, CSV and TSV. These are meant for
+// inspecting and diffing WordSets and for exchanging them with other tools;
+// the binary format written by Serialize is more compact.
+//
+// Words are always written in sorted order, so that the output is stable.
+
+package util
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Describes a CSV or TSV layout. Column indices count from 0; a negative
+// index means the field is absent. The word and weight columns must be
+// present, and no two fields may share a column.
+type CSVFormat struct {
+	// Field delimiter (',' for CSV, '\t' for TSV).
+	Comma rune
+
+	// Number of lines to skip at the start of the input when reading. When
+	// writing, a single header line is written iff this is positive.
+	HeaderLines int
+
+	WordColumn       int
+	WeightColumn     int
+	PosColumn        int
+	RankColumn       int
+	DispersionColumn int
+
+	// If non-nil, only records for which this returns true are read. Ignored
+	// when writing.
+	Filter func(record []string) bool
+}
+
+// Returns a CSV format with a header line and every field, in the order:
+// word, weight, part of speech, rank, dispersion.
+func NewCSVFormat() CSVFormat {
+	return CSVFormat{',', 1, 0, 1, 2, 3, 4, nil}
+}
+
+// Like NewCSVFormat, but tab-separated.
+func NewTSVFormat() CSVFormat {
+	format := NewCSVFormat()
+	format.Comma = '\t'
+	return format
+}
+
+// Writes this set's words in the given format. Unknown attributes are
+// written as empty cells.
+func (self WordSet) WriteCSV(out io.Writer, format CSVFormat) error {
+	columns, err := format.numColumns()
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(out)
+	w.Comma = format.Comma
+
+	if format.HeaderLines > 0 {
+		header := make([]string, columns)
+		format.set(header, format.WordColumn, "word")
+		format.set(header, format.WeightColumn, "weight")
+		format.set(header, format.PosColumn, "pos")
+		format.set(header, format.RankColumn, "rank")
+		format.set(header, format.DispersionColumn, "dispersion")
+		if err := w.Write(header); err != nil {
+			return err
+		}
+	}
+
+	self.Each(func(word WeightedWord) bool {
+		record := make([]string, columns)
+		format.set(record, format.WordColumn, word.Word)
+		format.set(record, format.WeightColumn,
+			strconv.FormatInt(word.Weight, 10))
+
+		attributes := word.Attributes
+		format.set(record, format.PosColumn, attributes.PartOfSpeech)
+		if attributes.Rank != 0 {
+			format.set(record, format.RankColumn,
+				strconv.FormatInt(attributes.Rank, 10))
+		}
+		if attributes.Dispersion != 0 {
+			format.set(record, format.DispersionColumn,
+				strconv.FormatFloat(attributes.Dispersion, 'g', -1, 64))
+		}
+		err = w.Write(record)
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+
+	w.Flush()
+	return w.Error()
+}
+
+// Reads a WordSet in the given format. Repeated words are merged as by
+// NewWordSetFromSlice. If 'composite' is true, the result uses composite
+// (Word, PartOfSpeech) keys.
+func ReadCSV(in io.Reader, format CSVFormat,
+	composite bool) (WordSet, error) {
+	if _, err := format.numColumns(); err != nil {
+		return NewWordSet(), err
+	}
+	r := csv.NewReader(in)
+	r.Comma = format.Comma
+	// Disable field count checking.
+	r.FieldsPerRecord = -1
+
+	words := make([]WeightedWord, 0)
+	for line := 0; true; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return NewWordSet(), err
+		}
+		if line < format.HeaderLines {
+			continue
+		}
+		if format.Filter != nil && !format.Filter(record) {
+			continue
+		}
+
+		word, err := format.parseRecord(record)
+		if err != nil {
+			return NewWordSet(), fmt.Errorf("Line %d: %v", line+1, err)
+		}
+		words = append(words, word)
+	}
+
+	return newWordSetFromSlice(words, composite)
+}
+
+// Marshals this set as TSV in the format given by NewTSVFormat. The key mode
+// is not recorded.
+func (self WordSet) MarshalText() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := self.WriteCSV(&buf, NewTSVFormat()); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Replaces the contents of this set with TSV text in the format given by
+// NewTSVFormat. The set keeps its current key mode.
+func (self *WordSet) UnmarshalText(text []byte) error {
+	words, err := ReadCSV(bytes.NewReader(text), NewTSVFormat(), self.composite)
+	if err != nil {
+		return err
+	}
+	*self = words
+	return nil
+}
+
+// JSON representation of a WordSet.
+type jsonWordSet struct {
+	Composite bool       `json:"composite,omitempty"`
+	Words     []jsonWord `json:"words"`
+}
+
+type jsonWord struct {
+	Word       string  `json:"word"`
+	Weight     int64   `json:"weight"`
+	Pos        string  `json:"pos,omitempty"`
+	Rank       int64   `json:"rank,omitempty"`
+	Dispersion float64 `json:"dispersion,omitempty"`
+}
+
+// Marshals this set as a JSON object with a "words" array (in sorted order)
+// and a "composite" flag.
+func (self WordSet) MarshalJSON() ([]byte, error) {
+	out := jsonWordSet{self.composite, make([]jsonWord, 0, self.Size())}
+	visit(self.root, 0, func(n *node, depth int) {
+		attributes := n.Word.Attributes
+		out.Words = append(out.Words, jsonWord{n.Word.Word, n.Word.Weight,
+			attributes.PartOfSpeech, attributes.Rank, attributes.Dispersion})
+	})
+	return json.Marshal(out)
+}
+
+// Replaces the contents of this set with the JSON produced by MarshalJSON.
+func (self *WordSet) UnmarshalJSON(data []byte) error {
+	var in jsonWordSet
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	words := make([]WeightedWord, len(in.Words))
+	for i, word := range in.Words {
+		words[i] = WeightedWord{word.Word, word.Weight,
+			WordAttributes{word.Pos, word.Rank, word.Dispersion}}
+	}
+	result, err := newWordSetFromSlice(words, in.Composite)
+	if err != nil {
+		return err
+	}
+	*self = result
+	return nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// HELPERS
+
+// Returns the number of columns in a record, after checking that the format
+// is usable.
+func (self CSVFormat) numColumns() (int, error) {
+	if self.WordColumn < 0 || self.WeightColumn < 0 {
+		return 0, fmt.Errorf("Word and weight columns are required")
+	}
+	columns := 0
+	used := make(map[int]bool)
+	for _, column := range []int{self.WordColumn, self.WeightColumn,
+		self.PosColumn, self.RankColumn, self.DispersionColumn} {
+		if column < 0 {
+			continue
+		}
+		if used[column] {
+			return 0, fmt.Errorf("Column %d is used for more than one field",
+				column)
+		}
+		used[column] = true
+		if column+1 > columns {
+			columns = column + 1
+		}
+	}
+	return columns, nil
+}
+
+// Sets record[column] to 'value', unless the column is absent.
+func (self CSVFormat) set(record []string, column int, value string) {
+	if column >= 0 {
+		record[column] = value
+	}
+}
+
+// Gets record[column], or "" if the column is absent.
+func (self CSVFormat) get(record []string, column int) (string, error) {
+	if column < 0 {
+		return "", nil
+	}
+	if column >= len(record) {
+		return "", fmt.Errorf("Missing column %d", column)
+	}
+	return record[column], nil
+}
+
+func (self CSVFormat) parseRecord(record []string) (WeightedWord, error) {
+	var word WeightedWord
+	var cell string
+	var err error
+
+	if word.Word, err = self.get(record, self.WordColumn); err != nil {
+		return word, err
+	}
+	if cell, err = self.get(record, self.WeightColumn); err != nil {
+		return word, err
+	}
+	if word.Weight, err = strconv.ParseInt(cell, 10, 64); err != nil {
+		return word, err
+	}
+
+	if word.Attributes.PartOfSpeech, err =
+		self.get(record, self.PosColumn); err != nil {
+		return word, err
+	}
+	if cell, err = self.get(record, self.RankColumn); err != nil {
+		return word, err
+	}
+	if cell != "" {
+		if word.Attributes.Rank, err = strconv.ParseInt(cell, 10, 64); err != nil {
+			return word, err
+		}
+		if word.Attributes.Rank < 0 {
+			return word, fmt.Errorf("Negative rank: %d", word.Attributes.Rank)
+		}
+	}
+	if cell, err = self.get(record, self.DispersionColumn); err != nil {
+		return word, err
+	}
+	if cell != "" {
+		if word.Attributes.Dispersion, err =
+			strconv.ParseFloat(cell, 64); err != nil {
+			return word, err
+		}
+	}
+	return word, nil
+}
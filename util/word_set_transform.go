@@ -0,0 +1,250 @@
+// Weight transforms for sampling. A transform maps each word's weight to the
+// weight actually used when sampling, which lets callers reshape a corpus's
+// distribution (for example, to favor rare words) without modifying the
+// WordSet. A TransformedIndex holds the transformed subtree sums, so that
+// repeated sampling only pays for the transform once.
+//
+// Transforms cost O(Size()) to apply, so they are meant for nonlinear
+// reshaping. An additive bias needs no transform: the nodeBias of
+// SampleDistinct applies it on the fly.
+
+package util
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// Maps a word to the (nonnegative) weight used for sampling it. Words mapped
+// to zero are never sampled.
+type WeightTransform func(word WeightedWord) float64
+
+// Raises each weight to the power 'p'. Exponents below 1 flatten the
+// distribution; exponents above 1 sharpen it.
+func Power(p float64) WeightTransform {
+	return func(word WeightedWord) float64 {
+		return math.Pow(float64(word.Weight), p)
+	}
+}
+
+// Softmax-style temperature scaling: equivalent to Power(1/t). High
+// temperatures approach uniform sampling.
+func Temperature(t float64) WeightTransform {
+	return Power(1 / t)
+}
+
+// Replaces each weight with log(1 + weight).
+func Log() WeightTransform {
+	return func(word WeightedWord) float64 {
+		return math.Log1p(float64(word.Weight))
+	}
+}
+
+// Replaces each weight with its reciprocal, so rare words are favored.
+func InverseFrequency() WeightTransform {
+	return func(word WeightedWord) float64 {
+		return 1 / float64(word.Weight)
+	}
+}
+
+// Replaces each weight with f(rank), where 'rank' is the number of words in
+// 'set' with a strictly greater weight (so the heaviest word has rank 0).
+// For example, f(rank) = 1 for 1000 <= rank < 3000 samples uniformly from
+// that frequency band.
+func RankTransform(set WordSet, f func(rank int64) float64) WeightTransform {
+	weights := make([]int64, 0, set.Size())
+	visit(set.root, 0, func(n *node, depth int) {
+		weights = append(weights, n.Word.Weight)
+	})
+	sort.Slice(weights, func(i, j int) bool {
+		return weights[i] > weights[j]
+	})
+	return func(word WeightedWord) float64 {
+		rank := sort.Search(len(weights), func(i int) bool {
+			return weights[i] <= word.Weight
+		})
+		return f(int64(rank))
+	}
+}
+
+// Like SampleDistinct, but samples according to the transformed weights.
+// Returns an error if 'transform' produces a negative, infinite or NaN
+// weight, or if fewer than 'n' words have positive transformed weight.
+//
+// This applies 'transform' to every word, so it costs O(Size()) before the
+// first draw. Callers which sample repeatedly with the same transform should
+// build a TransformedIndex once instead.
+func (self WordSet) SampleTransformed(r *rand.Rand, n int64,
+	transform WeightTransform) (WordSet, error) {
+	index, err := NewTransformedIndex(self, transform)
+	if err != nil {
+		return NewWordSet(), err
+	}
+	return index.Sample(r, n)
+}
+
+// The transformed weights of a WordSet, summed over each subtree. Building
+// an index costs O(Size()); after that, each draw costs O(log Size()). An
+// index is read-only, so it may be shared between goroutines, and it is
+// unaffected by later updates to the WordSet it was built from.
+type TransformedIndex struct {
+	root      *transformedNode
+	size      int64
+	composite bool
+}
+
+// Applies 'transform' to every word in 'set'. Returns an error if
+// 'transform' produces a negative, infinite or NaN weight.
+func NewTransformedIndex(set WordSet,
+	transform WeightTransform) (*TransformedIndex, error) {
+	root, err := buildTransformed(set.root, transform)
+	if err != nil {
+		return nil, err
+	}
+	return &TransformedIndex{root, set.Size(), set.composite}, nil
+}
+
+// Gets the number of words in the index.
+func (self *TransformedIndex) Size() int64 {
+	return self.size
+}
+
+// Draws 'n' distinct words with probability proportional to their
+// transformed weights, as SampleTransformed does. Returns an error if fewer
+// than 'n' words have positive transformed weight.
+func (self *TransformedIndex) Sample(r *rand.Rand, n int64) (WordSet, error) {
+	if n < 0 {
+		return NewWordSet(), fmt.Errorf("Cannot sample %d words", n)
+	}
+	if n > self.size {
+		return NewWordSet(), fmt.Errorf(
+			"Cannot sample %d words from a WordSet of size %d", n, self.size)
+	}
+
+	s := &transformedSampler{
+		make(map[*transformedNode]float64),
+		make(map[*transformedNode]bool),
+	}
+	sample := WordSet{nil, nil, self.composite}
+	var path []*transformedNode
+	for sample.Size() < n {
+		total := s.remaining(self.root)
+		if total <= 0 {
+			return NewWordSet(), fmt.Errorf(
+				"Only %d words have positive weight; cannot sample %d",
+				sample.Size(), n)
+		}
+		point := r.Float64() * total
+		path = path[:0]
+		cur := self.root
+		for {
+			path = append(path, cur)
+
+			leftWeight := s.remaining(cur.left)
+			if point < leftWeight {
+				cur = cur.left
+				continue
+			}
+			point -= leftWeight
+
+			curWeight := s.own(cur)
+			rightWeight := s.remaining(cur.right)
+			if point < curWeight || (curWeight > 0 && rightWeight <= 0) {
+				sample.Insert(cur.word)
+				s.drawn[cur] = true
+				s.update(path)
+				break
+			}
+			point -= curWeight
+
+			if rightWeight > 0 {
+				cur = cur.right
+				continue
+			}
+			// Rounding carried 'point' past the end of this subtree. Fall back to
+			// the last drawable word in the left subtree.
+			point = leftWeight
+			cur = cur.left
+		}
+	}
+	return sample, nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// HELPERS
+
+// A node of a TransformedIndex. The index has the same shape as the tree it
+// was built from.
+type transformedNode struct {
+	left, right *transformedNode
+	word        WeightedWord
+	// Transformed weight of 'word'.
+	weight float64
+	// Total transformed weight of this subtree.
+	sum float64
+}
+
+func buildTransformed(n *node,
+	transform WeightTransform) (*transformedNode, error) {
+	if n == nil {
+		return nil, nil
+	}
+	left, err := buildTransformed(n.Left, transform)
+	if err != nil {
+		return nil, err
+	}
+	right, err := buildTransformed(n.Right, transform)
+	if err != nil {
+		return nil, err
+	}
+	w := transform(n.Word)
+	if w < 0 || math.IsInf(w, 0) || math.IsNaN(w) {
+		return nil, fmt.Errorf("Bad transformed weight for %q: %v", n.Word.Word, w)
+	}
+	return &transformedNode{left, right, n.Word, w,
+		transformedSum(left) + w + transformedSum(right)}, nil
+}
+
+func transformedSum(n *transformedNode) float64 {
+	if n == nil {
+		return 0
+	}
+	return n.sum
+}
+
+// The state of a single TransformedIndex.Sample call. Only the nodes on the
+// paths to drawn words have entries, so each draw costs O(log Size()).
+type transformedSampler struct {
+	// Total transformed weight of each subtree, excluding drawn words. Nodes
+	// without an entry have nothing drawn beneath them.
+	remainingWeight map[*transformedNode]float64
+	// Words which have already been drawn.
+	drawn map[*transformedNode]bool
+}
+
+func (self *transformedSampler) remaining(n *transformedNode) float64 {
+	if w, ok := self.remainingWeight[n]; ok {
+		return w
+	}
+	return transformedSum(n)
+}
+
+func (self *transformedSampler) own(n *transformedNode) float64 {
+	if self.drawn[n] {
+		return 0
+	}
+	return n.weight
+}
+
+// Recomputes the remaining sums along 'path', from the bottom up. Summing
+// the children, rather than subtracting the drawn weight, keeps fully drawn
+// subtrees at exactly zero.
+func (self *transformedSampler) update(path []*transformedNode) {
+	for i := len(path) - 1; i >= 0; i-- {
+		n := path[i]
+		self.remainingWeight[n] =
+			self.remaining(n.left) + self.own(n) + self.remaining(n.right)
+	}
+}
@@ -0,0 +1,28 @@
+// The word sets embedded in this package.
+
+package dorkalonius
+
+import (
+	"context"
+	"github.com/sethpollen/dorkalonius/util"
+)
+
+// Most memory the embedded word sets may hold at once, as estimated by
+// util.WordSetCost. Less recently used sets are evicted beyond this.
+const maxWordSetBytes = 512 << 20
+
+// The embedded word sets, keyed by the names of their word_set rules. Each
+// is loaded on first use.
+var wordSets = util.NewWordSetCache(map[string]util.WordSetLoader{
+	"coca_word_set": Load_coca_word_set,
+}, maxWordSetBytes)
+
+// Fetches an embedded word set by name, such as "coca_word_set".
+func GetWordSet(ctx context.Context, name string) (*util.WordSet, error) {
+	return wordSets.Get(ctx, name)
+}
+
+// Reports how often the embedded word sets have been loaded and evicted.
+func WordSetStats() util.MemoMapStats {
+	return wordSets.Stats()
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
   "github.com/sethpollen/dorkalonius"
@@ -10,6 +11,7 @@ import (
 	"os"
 	"path"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -20,7 +22,15 @@ var sample_size = flag.Int("sample_size", 35,
 var outputWidth = flag.Int("output_width", -1,
 	"Width of the terminal where output will be shown.")
 var duration = flag.Duration("duration", 0,
-	"Duration for the game timer which runs after words are printed.")
+	"Duration of the writing phase, which starts after words are printed.")
+var readingDuration = flag.Duration("reading_duration", 0,
+	"Duration of the reading phase, which follows the writing phase.")
+var votingDuration = flag.Duration("voting_duration", 0,
+	"Duration of the voting phase, which follows the reading phase.")
+var seed = flag.Int64("seed", 0,
+	"Random seed. If absent, a seed is chosen from the clock. Game N of "+
+		"--output_files uses seed --seed+N, so every game can be reproduced "+
+		"from the seed printed with it.")
 
 var outputDir = flag.String("output_dir", "",
 	"If provided, output will be written to files in this directory instead "+
@@ -32,27 +42,42 @@ var outputFiles = flag.Int("output_files", 1,
 
 func main() {
 	flag.Parse()
-	rand.Seed(time.Now().UTC().UnixNano())
+
+	seedSet := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "seed" {
+			seedSet = true
+		}
+	})
+	if !seedSet {
+		*seed = time.Now().UTC().UnixNano()
+	}
 
 	if *sample_size < 0 {
 		log.Fatalln("--sample_size must be nonnegative")
 	}
-	var err error
-
-	words := dorkalonius.Get_coca_word_set()
+	// The sampling tables are built once and shared by every game.
+	ctx := context.Background()
+	wordSet, err := dorkalonius.Get_coca_word_set(ctx)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	generator, err := dorkalonius.NewGameGenerator(ctx, wordSet)
+	if err != nil {
+		log.Fatalln(err)
+	}
 
 	if *outputDir == "" {
 		fmt.Println()
-		err = generateGame(words, os.Stdout)
+		err = generateGame(generator, *seed, os.Stdout)
 		if err != nil {
 			log.Fatalln(err)
 		}
 		fmt.Println()
 
-		if *duration > 0 {
-			util.VerboseSleep(*duration, true)
-			fmt.Println("TIME'S UP")
-			fmt.Println()
+		err = runRound()
+		if err != nil {
+			log.Fatalln(err)
 		}
 		return
 	}
@@ -70,17 +95,46 @@ func main() {
 		if err != nil {
 			log.Fatalln(err)
 		}
-		err = generateGame(words, out)
+		err = generateGame(generator, *seed+int64(i), out)
 		if err != nil {
 			log.Fatalln(err)
 		}
 	}
 }
 
-func generateGame(wordSet *util.WordSet, out *os.File) error {
-	var err error
-	game := dorkalonius.NewGame(wordSet)
+// Runs the timed phases of a round, printing a countdown for each.
+func runRound() error {
+	round := dorkalonius.NewRound(dorkalonius.RoundConfig{
+		WritingDuration: *duration,
+		ReadingDuration: *readingDuration,
+		VotingDuration:  *votingDuration,
+		TickInterval:    time.Second,
+	}, util.SystemClock)
+	round.Subscribe(func(event dorkalonius.RoundEvent) {
+		if event.Timer.Kind == util.TimerStarted {
+			fmt.Printf("%s PHASE\n", strings.ToUpper(event.Phase.String()))
+		}
+		util.TimerDisplay{
+			Out:   os.Stdout,
+			Label: "Time left: ",
+			Done:  "TIME'S UP\n",
+			Bell:  true,
+		}.Handle(event.Timer)
+	})
+	return round.Run(context.Background())
+}
+
+func generateGame(generator *dorkalonius.GameGenerator, seed int64,
+	out *os.File) error {
+	game, err := generator.NewGame(rand.New(rand.NewSource(seed)))
+	if err != nil {
+		return err
+	}
 
+	_, err = out.WriteString(fmt.Sprintf("SEED: %d\n\n", seed))
+	if err != nil {
+		return err
+	}
 	_, err = out.WriteString(fmt.Sprintf("TARGET WORD: %s\n\n",
 		game.TargetWord))
 	if err != nil {